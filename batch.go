@@ -0,0 +1,295 @@
+package ws_rpc
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+//批量调用中的一项
+type BatchCall struct {
+	Waiter string
+	Method string
+	In     interface{}
+}
+
+//批量调用中一项的结果,Err为*RPCError
+type BatchResult struct {
+	Out interface{}
+	Err error
+}
+
+//将结果解码到v,v需为非nil指针
+func (r BatchResult) Decode(v interface{}) error {
+	if r.Err != nil {
+		return r.Err
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errors.New("decode target must be a non-nil pointer")
+	}
+	val, err := decodeValue(r.Out, rv.Elem().Type())
+	if err != nil {
+		return err
+	}
+	rv.Elem().Set(val)
+	return nil
+}
+
+//批量调用,多个调用在一帧内发送
+type batchData struct {
+	Type       string     `json:"t"`
+	Random     string     `json:"i"`
+	Calls      []callData `json:"c"`
+	Sequential bool       `json:"o,omitempty"` //按顺序执行
+}
+
+//批量调用结果,与调用顺序一致
+type batchResultData struct {
+	Type    string       `json:"t"`
+	Random  string       `json:"i"`
+	Results []resultData `json:"r"`
+}
+
+func createBatchData(codec Codec, rand string, calls []BatchCall, sequential bool) ([]byte, error) {
+	d := batchData{
+		Type:       "batch",
+		Random:     rand,
+		Calls:      make([]callData, len(calls)),
+		Sequential: sequential,
+	}
+	for i, call := range calls {
+		d.Calls[i] = callData{
+			Waiter: stringToLower(call.Waiter),
+			Method: call.Method,
+			In:     call.In,
+			Random: "c" + strconv.Itoa(i),
+		}
+	}
+	return codec.Marshal(&d)
+}
+
+func createBatchResultData(codec Codec, batch *batchData, results []resultData) ([]byte, error) {
+	d := batchResultData{
+		Type:    "batch_result",
+		Random:  batch.Random,
+		Results: results,
+	}
+	return codec.Marshal(&d)
+}
+
+func isBatchWsFunc(codec Codec, msg []byte) (*batchData, bool) {
+	res := new(batchData)
+	err := codec.Unmarshal(msg, res)
+	if err != nil {
+		return nil, false
+	}
+	if res.Type != "batch" || res.Random == "" {
+		return nil, false
+	}
+	for i := range res.Calls {
+		if res.Calls[i].Random != "" {
+			res.Calls[i].Random = res.Calls[i].Random[1:]
+		}
+	}
+	return res, true
+}
+
+func isBatchResultWsFunc(codec Codec, msg []byte) (*batchResultData, bool) {
+	res := new(batchResultData)
+	err := codec.Unmarshal(msg, res)
+	if err != nil {
+		return nil, false
+	}
+	if res.Type != "batch_result" || res.Random == "" {
+		return nil, false
+	}
+	return res, true
+}
+
+//执行批量调用,sequential为true时按顺序执行,否则并发执行,limit大于0时同时执行的项不超过limit
+func runBatch(batch *batchData, limit int, invoke func(call *callData) (interface{}, error)) []resultData {
+	results := make([]resultData, len(batch.Calls))
+	run := func(i int) {
+		call := &batch.Calls[i]
+		out, err := invoke(call)
+		results[i] = resultData{
+			Waiter: call.Waiter,
+			Method: call.Method,
+			Out:    out,
+			Err:    toRPCError(err),
+			Random: "r" + call.Random,
+		}
+	}
+	if batch.Sequential {
+		for i := range batch.Calls {
+			run(i)
+		}
+		return results
+	}
+	runLimited(len(batch.Calls), limit, run)
+	return results
+}
+
+//处理队列已满时整批回复CodeBusy错误
+func createBusyBatchResultData(codec Codec, batch *batchData) ([]byte, error) {
+	return createErrorBatchResultData(codec, batch, errBusy())
+}
+
+//每项均回复err
+func createErrorBatchResultData(codec Codec, batch *batchData, err error) ([]byte, error) {
+	b := *batch
+	b.Sequential = true
+	results := runBatch(&b, 0, func(call *callData) (interface{}, error) {
+		return nil, err
+	})
+	return createBatchResultData(codec, &b, results)
+}
+
+//等待批量调用结果,ctx结束时执行onCancel通知对端
+func waitBatchResult(ctx context.Context, back chan *batchResultData, n int, onCancel func()) ([]BatchResult, error) {
+	select {
+	case res, ok := <-back:
+		if !ok {
+			return nil, errClosed()
+		}
+		if len(res.Results) != n {
+			return nil, Errorf(CodeInternal, "batch result count %d, want %d", len(res.Results), n)
+		}
+		out := make([]BatchResult, n)
+		for i, r := range res.Results {
+			out[i].Out = r.Out
+			if r.Err != nil && (r.Err.Code != 0 || r.Err.Message != "") {
+				out[i].Err = r.Err
+			}
+		}
+		return out, nil
+	case <-ctx.Done():
+		onCancel()
+		return nil, ctxError(ctx)
+	}
+}
+
+//批量调用服务端方法,超时时间为TimeOut秒
+func (w *WSRpcClient) CallBatch(calls []BatchCall, sequential bool) ([]BatchResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(TimeOut)*time.Second)
+	defer cancel()
+	return w.CallBatchContext(ctx, calls, sequential)
+}
+
+//批量调用服务端方法,所有调用在一帧内发送,结果按调用顺序返回,各项错误见BatchResult.Err
+func (w *WSRpcClient) CallBatchContext(ctx context.Context, calls []BatchCall, sequential bool) ([]BatchResult, error) {
+	return interceptBatch(ctx, w.interceptors, nil, calls, func(ctx context.Context, calls []BatchCall) ([]BatchResult, error) {
+		id, back := w.batches.add()
+		defer w.batches.remove(id)
+		res, err := createBatchData(w.codec, id, calls, sequential)
+		if err != nil {
+			return nil, err
+		}
+		err = w.send(res)
+		if err != nil {
+			return nil, sendError(err)
+		}
+		return waitBatchResult(ctx, back, len(calls), func() {
+			if m, err := createCancelData(w.codec, id); err == nil {
+				w.send(m)
+			}
+		})
+	})
+}
+
+//在读取时登记服务端发来的批量调用,投递到处理池执行,队列满时按策略回复CodeBusy错误或丢弃
+func (w *WSRpcClient) submitBatch(batch *batchData) {
+	ctx, done := w.running.add(batch.Random)
+	policy, ok := submit(func() { w.runBatch(ctx, batch, done) }, w.pool)
+	if ok {
+		return
+	}
+	done()
+	if policy == OverflowReject {
+		if m, err := createBusyBatchResultData(w.codec, batch); err == nil {
+			w.send(m)
+		}
+	}
+}
+
+//执行服务端发来的批量调用,各项并发数不超过处理池的Workers
+func (w *WSRpcClient) runBatch(ctx context.Context, batch *batchData, done func()) {
+	defer done()
+	results := runBatch(batch, w.pool.limit(), func(call *callData) (interface{}, error) {
+		return w.invoke(ctx, call, nil)
+	})
+	m, err := createBatchResultData(w.codec, batch, results)
+	if err != nil {
+		return
+	}
+	w.send(m)
+}
+
+//批量调用客户端方法,超时时间为TimeOut秒
+func CallClientBatch(client *Client, calls []BatchCall, sequential bool) ([]BatchResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(TimeOut)*time.Second)
+	defer cancel()
+	return CallClientBatchContext(ctx, client, calls, sequential)
+}
+
+//批量调用客户端方法,所有调用在一帧内发送,结果按调用顺序返回,各项错误见BatchResult.Err
+func CallClientBatchContext(ctx context.Context, client *Client, calls []BatchCall, sequential bool) ([]BatchResult, error) {
+	if client == nil {
+		return nil, errClosed()
+	}
+	return interceptBatch(ctx, client.interceptors, client, calls, func(ctx context.Context, calls []BatchCall) ([]BatchResult, error) {
+		if client.jsonrpc {
+			return callClientJSONRPCBatch(ctx, client, calls)
+		}
+		id, back := client.batches.add()
+		defer client.batches.remove(id)
+		res, err := createBatchData(client.codec, id, calls, sequential)
+		if err != nil {
+			return nil, err
+		}
+		if err = sendData(client, res); err != nil {
+			return nil, err
+		}
+		return waitBatchResult(ctx, back, len(calls), func() {
+			if m, err := createCancelData(client.codec, id); err == nil {
+				sendData(client, m)
+			}
+		})
+	})
+}
+
+//在读取时登记客户端发来的批量调用,投递到处理池执行,队列满时按策略回复CodeBusy错误或丢弃
+func (ws *wsMethod) submitBatch(client *Client, batch *batchData) {
+	ctx, done := client.running.add(batch.Random)
+	policy, ok := client.submit(func() { ws.runBatch(ctx, client, batch, done) })
+	if ok {
+		return
+	}
+	done()
+	if policy == OverflowReject {
+		if m, err := createBusyBatchResultData(client.codec, batch); err == nil {
+			sendData(client, m)
+		}
+	}
+}
+
+//执行客户端发来的批量调用,各项并发数不超过连接与服务处理池的Workers
+func (ws *wsMethod) runBatch(ctx context.Context, client *Client, batch *batchData, done func()) {
+	defer done()
+	results := runBatch(batch, client.limit(), func(call *callData) (interface{}, error) {
+		return ws.invoke(ctx, client, call, nil)
+	})
+	m, err := createBatchResultData(client.codec, batch, results)
+	if err == nil {
+		err = sendData(client, m)
+	}
+	if err != nil {
+		//结果无法编码或超出客户端消息大小上限
+		if m, err = createErrorBatchResultData(client.codec, batch, err); err == nil {
+			sendData(client, m)
+		}
+	}
+}
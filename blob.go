@@ -0,0 +1,629 @@
+package ws_rpc
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+//分块大小
+const blobChunkSize = 64 << 10
+
+//发送方最多有这么多块未被接收方确认
+const blobWindow = 16
+
+//数据块帧以此开头,json,msgpack与旧编码的帧均不会以此开头
+var blobMagic = []byte{0x00, 'B'}
+
+//传输的文件信息
+type BlobInfo struct {
+	Id   string                 `json:"id"` //传输id,续传时需与上次相同,为空时随机生成
+	Name string                 `json:"name,omitempty"`
+	Size int64                  `json:"size"`
+	Meta map[string]interface{} `json:"meta,omitempty"`
+}
+
+//传输进度,done为对端已确认的字节数
+type ProgressFunc func(info BlobInfo, done int64)
+
+//接收端存储,已写入的部分在断开后保留,用于续传
+type BlobStore interface {
+	//打开传输id对应的文件,返回已写入的字节数
+	//c为发送方的连接,客户端接收时为nil,不同发送方的相同id需区分,避免续传他人的文件
+	Open(c *Client, info BlobInfo) (BlobFile, int64, error)
+}
+
+type BlobFile interface {
+	io.WriterAt
+	io.ReaderAt
+	//校验通过,完成传输
+	Commit() error
+	//校验失败,删除已写入的数据
+	Discard() error
+	//传输中断,保留已写入的数据
+	Close() error
+}
+
+//接收端配置,Done在传输完成或失败时调用,客户端接收时c为nil
+type BlobReceiver struct {
+	Store    BlobStore
+	Progress ProgressFunc
+	Done     func(c *Client, info BlobInfo, err error)
+}
+
+//传输控制帧
+type blobData struct {
+	Type   string    `json:"t"` //blob_start:开始 blob_ack:确认 blob_end:发送完毕
+	Random string    `json:"i"`
+	Seq    string    `json:"s,omitempty"` //每次发送不同,确认帧原样带回,区分续传前的确认
+	Info   *BlobInfo `json:"b,omitempty"`
+	Offset int64     `json:"o,omitempty"` //接收方已写入的字节数
+	Sum    string    `json:"h,omitempty"` //整个文件的sha256
+	Done   bool      `json:"f,omitempty"` //接收方校验通过
+	Err    *RPCError `json:"d,omitempty"`
+}
+
+func createBlobData(codec Codec, d *blobData) ([]byte, error) {
+	return codec.Marshal(d)
+}
+
+func isBlobWsFunc(codec Codec, msg []byte) (*blobData, bool) {
+	if isBlobChunk(msg) {
+		return nil, false
+	}
+	res := new(blobData)
+	if err := codec.Unmarshal(msg, res); err != nil {
+		return nil, false
+	}
+	switch res.Type {
+	case "blob_start", "blob_ack", "blob_end":
+	default:
+		return nil, false
+	}
+	if res.Random == "" {
+		return nil, false
+	}
+	if res.Err != nil && res.Err.Code == 0 && res.Err.Message == "" {
+		res.Err = nil
+	}
+	return res, true
+}
+
+//数据块: magic,id长度,id,偏移(8字节),crc32(4字节),数据
+type blobChunk struct {
+	id     string
+	offset int64
+	sum    uint32
+	data   []byte
+}
+
+func createBlobChunk(id string, offset int64, data []byte) []byte {
+	b := make([]byte, 0, len(blobMagic)+1+len(id)+12+len(data))
+	b = append(b, blobMagic...)
+	b = append(b, byte(len(id)))
+	b = append(b, id...)
+	b = binary.BigEndian.AppendUint64(b, uint64(offset))
+	b = binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(data))
+	return append(b, data...)
+}
+
+func isBlobChunk(msg []byte) bool {
+	return bytes.HasPrefix(msg, blobMagic)
+}
+
+func parseBlobChunk(msg []byte) (*blobChunk, bool) {
+	if !isBlobChunk(msg) || len(msg) < len(blobMagic)+1 {
+		return nil, false
+	}
+	msg = msg[len(blobMagic):]
+	n := int(msg[0])
+	if len(msg) < 1+n+12 {
+		return nil, false
+	}
+	c := &blobChunk{id: string(msg[1 : 1+n])}
+	msg = msg[1+n:]
+	c.offset = int64(binary.BigEndian.Uint64(msg))
+	c.sum = binary.BigEndian.Uint32(msg[8:])
+	c.data = msg[12:]
+	return c, true
+}
+
+//连接上的传输,发送方等待确认,接收方按顺序写入
+type blobTable struct {
+	sending   sync.Map //id-->chan *blobData
+	receiving sync.Map //id-->*blobRecv
+}
+
+//连接断开,结束所有传输
+func (t *blobTable) closeAll() {
+	t.sending.Range(func(k, v interface{}) bool {
+		if ch, ok := t.sending.LoadAndDelete(k); ok {
+			close(ch.(chan *blobData))
+		}
+		return true
+	})
+	t.receiving.Range(func(k, v interface{}) bool {
+		v.(*blobRecv).finish(errClosed())
+		return true
+	})
+}
+
+//投递确认帧,发送方受窗口限制,缓冲不会被占满
+func (t *blobTable) ack(d *blobData) {
+	if ch, ok := t.sending.Load(d.Random); ok {
+		select {
+		case ch.(chan *blobData) <- d:
+		default:
+		}
+	}
+}
+
+//发送文件,r从头读取,对端已有部分数据时从断点继续
+func sendBlob(ctx context.Context, table *blobTable, codec Codec, send, sendChunk func([]byte) error,
+	chunkSize int, info BlobInfo, r io.ReadSeeker, progress ProgressFunc) error {
+	if info.Id == "" {
+		//随机id,避免与其他发送方的id相同或被猜到
+		id, err := uuid.NewV4()
+		if err != nil {
+			return err
+		}
+		info.Id = id.String()
+	}
+	if len(info.Id) > 255 {
+		return NewError(CodeInvalidRequest, "blob id too long")
+	}
+	if info.Size <= 0 {
+		size, err := r.Seek(0, io.SeekEnd)
+		if err != nil {
+			return err
+		}
+		info.Size = size
+	}
+	acks := make(chan *blobData, blobWindow+4)
+	if _, loaded := table.sending.LoadOrStore(info.Id, acks); loaded {
+		return Errorf(CodeInvalidRequest, "blob %s is already sending", info.Id)
+	}
+	defer table.sending.Delete(info.Id)
+	seq := nextId()
+	wait := func() (*blobData, error) {
+		select {
+		case ack, ok := <-acks:
+			if !ok {
+				return nil, errClosed()
+			}
+			if ack.Seq != seq {
+				//上次发送的确认
+				return &blobData{Offset: -1}, nil
+			}
+			if ack.Err != nil {
+				return nil, ack.Err
+			}
+			if progress != nil {
+				progress(info, ack.Offset)
+			}
+			return ack, nil
+		case <-ctx.Done():
+			//通知接收方停止,已写入的部分保留
+			if m, err := createBlobData(codec, &blobData{Type: "blob_end", Random: info.Id, Err: ctxError(ctx)}); err == nil {
+				send(m)
+			}
+			return nil, ctxError(ctx)
+		}
+	}
+	m, err := createBlobData(codec, &blobData{Type: "blob_start", Random: info.Id, Seq: seq, Info: &info})
+	if err != nil {
+		return err
+	}
+	if err = send(m); err != nil {
+		return sendError(err)
+	}
+	var ack *blobData
+	for ack == nil || ack.Offset < 0 {
+		if ack, err = wait(); err != nil {
+			return err
+		}
+	}
+	offset := ack.Offset
+	if offset < 0 || offset > info.Size {
+		return Errorf(CodeInvalidRequest, "bad resume offset %d", offset)
+	}
+	//续传时已发送部分也计入校验
+	h := sha256.New()
+	if _, err = r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err = io.CopyN(h, r, offset); err != nil {
+		return err
+	}
+	buf := make([]byte, chunkSize)
+	sent, acked := offset, offset
+	for sent < info.Size {
+		for sent-acked >= int64(blobWindow*chunkSize) {
+			if ack, err = wait(); err != nil {
+				return err
+			}
+			if ack.Offset > acked {
+				acked = ack.Offset
+			}
+		}
+		n := int64(chunkSize)
+		if info.Size-sent < n {
+			n = info.Size - sent
+		}
+		if _, err = io.ReadFull(r, buf[:n]); err != nil {
+			return err
+		}
+		h.Write(buf[:n])
+		if err = sendChunk(createBlobChunk(info.Id, sent, buf[:n])); err != nil {
+			return sendError(err)
+		}
+		sent += n
+	}
+	m, err = createBlobData(codec, &blobData{Type: "blob_end", Random: info.Id, Sum: hex.EncodeToString(h.Sum(nil))})
+	if err != nil {
+		return err
+	}
+	if err = send(m); err != nil {
+		return sendError(err)
+	}
+	for {
+		if ack, err = wait(); err != nil {
+			return err
+		}
+		if ack.Done {
+			return nil
+		}
+	}
+}
+
+//接收中的传输
+type blobRecv struct {
+	info     BlobInfo
+	seq      string
+	file     BlobFile
+	written  int64
+	frames   chan interface{} //*blobChunk或*blobData
+	done     chan struct{}
+	once     sync.Once
+	err      error
+	canceled bool          //发送方取消或连接断开
+	exited   chan struct{} //接收协程已退出
+	client   *Client
+	receiver *BlobReceiver
+	send     func([]byte) error
+	codec    Codec
+	onClose  func()
+}
+
+//结束传输,err为nil时已完成
+func (b *blobRecv) finish(err error) {
+	b.once.Do(func() {
+		b.err = err
+		close(b.done)
+		if b.onClose != nil {
+			b.onClose()
+		}
+	})
+}
+
+//读取协程投递收到的帧,不阻塞读取
+//发送方受窗口限制,缓冲已满时发送方违反协议,回复错误并结束接收
+func (b *blobRecv) deliver(f interface{}) {
+	select {
+	case b.frames <- f:
+	case <-b.done:
+	default:
+		err := NewError(CodeInvalidRequest, "blob window exceeded")
+		b.reply(&blobData{Err: err})
+		b.finish(err)
+	}
+}
+
+func (b *blobRecv) reply(d *blobData) {
+	d.Type, d.Random, d.Seq = "blob_ack", b.info.Id, b.seq
+	if m, err := createBlobData(b.codec, d); err == nil {
+		b.send(m)
+	}
+}
+
+//等待上次的接收退出后打开文件,回复已写入的字节数后按顺序接收
+func (b *blobRecv) open(old *blobRecv) {
+	defer close(b.exited)
+	if old != nil {
+		<-old.exited
+	}
+	file, offset, err := b.receiver.Store.Open(b.client, b.info)
+	if err != nil {
+		b.reply(&blobData{Err: toRPCError(err)})
+		b.finish(err)
+		return
+	}
+	b.file, b.written = file, offset
+	b.reply(&blobData{Offset: offset})
+	b.run()
+}
+
+//按顺序写入数据块,发送完毕后校验
+func (b *blobRecv) run() {
+	err := b.loop()
+	if err == nil {
+		err = b.file.Commit()
+	} else {
+		var e *RPCError
+		if errors.As(err, &e) && e.Code == CodeInvalidParams {
+			//数据损坏,下次重新传输
+			b.file.Discard()
+		} else {
+			b.file.Close()
+		}
+	}
+	if err != nil {
+		if !b.canceled {
+			b.reply(&blobData{Err: toRPCError(err)})
+		}
+	} else {
+		b.reply(&blobData{Offset: b.written, Done: true})
+	}
+	b.finish(err)
+	if b.receiver.Done != nil {
+		b.receiver.Done(b.client, b.info, err)
+	}
+}
+
+func (b *blobRecv) loop() error {
+	for {
+		var f interface{}
+		select {
+		case f = <-b.frames:
+		case <-b.done:
+			//连接断开或发送方重新开始,不再回复
+			b.canceled = true
+			return b.err
+		}
+		switch f := f.(type) {
+		case *blobChunk:
+			if f.offset != b.written {
+				return Errorf(CodeInvalidParams, "blob chunk offset %d, want %d", f.offset, b.written)
+			}
+			if crc32.ChecksumIEEE(f.data) != f.sum {
+				return Errorf(CodeInvalidParams, "blob chunk at %d checksum mismatch", f.offset)
+			}
+			if b.written+int64(len(f.data)) > b.info.Size {
+				return Errorf(CodeInvalidParams, "blob exceeds size %d", b.info.Size)
+			}
+			if _, err := b.file.WriteAt(f.data, f.offset); err != nil {
+				return err
+			}
+			b.written += int64(len(f.data))
+			b.reply(&blobData{Offset: b.written})
+			if b.receiver.Progress != nil {
+				b.receiver.Progress(b.info, b.written)
+			}
+		case *blobData:
+			if f.Err != nil {
+				//发送方取消,不再回复
+				b.canceled = true
+				return f.Err
+			}
+			if b.written != b.info.Size {
+				return Errorf(CodeInvalidParams, "blob size %d, want %d", b.written, b.info.Size)
+			}
+			h := sha256.New()
+			if _, err := io.Copy(h, io.NewSectionReader(b.file, 0, b.written)); err != nil {
+				return err
+			}
+			if hex.EncodeToString(h.Sum(nil)) != f.Sum {
+				return NewError(CodeInvalidParams, "blob sha256 mismatch")
+			}
+			return nil
+		}
+	}
+}
+
+//处理传输帧,需在读取协程中按顺序调用,返回false时不是传输帧
+func (t *blobTable) dispatch(codec Codec, msg []byte, client *Client, receiver *BlobReceiver, send func([]byte) error) bool {
+	if chunk, ok := parseBlobChunk(msg); ok {
+		if b, ok := t.receiving.Load(chunk.id); ok {
+			b.(*blobRecv).deliver(chunk)
+		}
+		return true
+	}
+	d, ok := isBlobWsFunc(codec, msg)
+	if !ok {
+		return false
+	}
+	switch d.Type {
+	case "blob_ack":
+		t.ack(d)
+	case "blob_end":
+		if b, ok := t.receiving.Load(d.Random); ok {
+			b.(*blobRecv).deliver(d)
+		}
+	case "blob_start":
+		t.start(codec, d, client, receiver, send)
+	}
+	return true
+}
+
+//开始接收,回复已写入的字节数
+func (t *blobTable) start(codec Codec, d *blobData, client *Client, receiver *BlobReceiver, send func([]byte) error) {
+	b := &blobRecv{
+		seq:      d.Seq,
+		frames:   make(chan interface{}, blobWindow+2),
+		done:     make(chan struct{}),
+		exited:   make(chan struct{}),
+		client:   client,
+		receiver: receiver,
+		send:     send,
+		codec:    codec,
+	}
+	b.info.Id = d.Random
+	if d.Info != nil {
+		b.info = *d.Info
+		b.info.Id = d.Random
+	}
+	if receiver == nil || receiver.Store == nil {
+		b.reply(&blobData{Err: NewError(CodeInvalidRequest, "blob is not supported")})
+		return
+	}
+	var old *blobRecv
+	if o, ok := t.receiving.Load(b.info.Id); ok {
+		//发送方已重新开始,结束上次的接收
+		old = o.(*blobRecv)
+		old.finish(NewError(CodeCanceled, "blob restarted"))
+	}
+	t.receiving.Store(b.info.Id, b)
+	b.onClose = func() {
+		t.receiving.CompareAndDelete(b.info.Id, b)
+	}
+	//等待上次的写入停止与打开文件可能较慢,在接收协程中进行,不阻塞读取
+	go b.open(old)
+}
+
+//保存到目录的存储,传输中写入 id.part,完成后改名为 id
+//按发送方分目录保存,发送方已设置用户主键时为用户id,重连后可续传,否则为连接id,只能在同一连接上续传
+type FileBlobStore struct {
+	Dir string
+}
+
+func NewFileBlobStore(dir string) (*FileBlobStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FileBlobStore{Dir: dir}, nil
+}
+
+//传输完成后的文件路径,c为发送方的连接
+func (s *FileBlobStore) Path(c *Client, id string) string {
+	return filepath.Join(s.Dir, blobOwnerDir(c), blobFileName(id))
+}
+
+func (s *FileBlobStore) Open(c *Client, info BlobInfo) (BlobFile, int64, error) {
+	path := s.Path(c, info.Id)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, 0, err
+	}
+	f, err := os.OpenFile(path+".part", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, 0, err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	size := st.Size()
+	if size > info.Size {
+		//与本次传输不符,重新开始
+		if err = f.Truncate(0); err != nil {
+			f.Close()
+			return nil, 0, err
+		}
+		size = 0
+	}
+	return &fileBlob{File: f, path: path}, size, nil
+}
+
+type fileBlob struct {
+	*os.File
+	path string
+}
+
+func (f *fileBlob) Commit() error {
+	if err := f.File.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.path+".part", f.path)
+}
+
+func (f *fileBlob) Discard() error {
+	f.File.Close()
+	return os.Remove(f.path + ".part")
+}
+
+//文件名只保留安全字符
+func blobFileName(id string) string {
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, id)
+	return "blob_" + name
+}
+
+//发送方的目录名,用户id或连接id的摘要,客户端接收时所有文件来自服务端
+func blobOwnerDir(c *Client) string {
+	if c == nil {
+		return "server"
+	}
+	owner := "c:" + c.id
+	if c.userPrimary != "" {
+		if uid, ok := c.GetUserInfo()[c.userPrimary]; ok {
+			owner = "u:" + fmt.Sprint(uid)
+		}
+	}
+	sum := sha256.Sum256([]byte(owner))
+	return "from_" + hex.EncodeToString(sum[:12])
+}
+
+//分块大小不超过对端的消息上限
+func blobChunkFor(maxSize int64) int {
+	size := blobChunkSize
+	if maxSize > 0 && int64(size) > maxSize-512 {
+		size = int(maxSize - 512)
+	}
+	if size < 1 {
+		size = 1
+	}
+	return size
+}
+
+//发送文件到服务端,传输中断后以相同的info.Id再次调用时从断点继续
+func (w *WSRpcClient) SendBlob(ctx context.Context, info BlobInfo, r io.ReadSeeker, progress ProgressFunc) error {
+	var maxSize int64
+	if peer := w.Handshake(); peer != nil {
+		maxSize = peer.MaxMessageSize
+	}
+	return sendBlob(ctx, &w.blobs, w.codec, w.send, w.client.SendBinary, blobChunkFor(maxSize), info, r, progress)
+}
+
+//接收服务端发来的文件
+func (w *WSRpcClient) SetBlobReceiver(receiver *BlobReceiver) *WSRpcClient {
+	w.blob = receiver
+	return w
+}
+
+//发送文件到客户端,传输中断后以相同的info.Id再次调用时从断点继续
+func SendClientBlob(ctx context.Context, client *Client, info BlobInfo, r io.ReadSeeker, progress ProgressFunc) error {
+	if client == nil {
+		return errClosed()
+	}
+	if client.jsonrpc {
+		return NewError(CodeInvalidRequest, "blob is not supported in jsonrpc mode")
+	}
+	send := func(data []byte) error {
+		return sendData(client, data)
+	}
+	sendChunk := func(data []byte) error {
+		client.SendBinary(data)
+		return nil
+	}
+	var maxSize int64
+	if peer := client.Handshake(); peer != nil {
+		maxSize = peer.MaxMessageSize
+	}
+	return sendBlob(ctx, &client.blobs, client.codec, send, sendChunk, blobChunkFor(maxSize), info, r, progress)
+}
@@ -4,6 +4,8 @@ import (
 	"errors"
 	"github.com/gorilla/websocket"
 	"log"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -14,9 +16,11 @@ type WSClient struct {
 	conf      ClientConf
 	method    func(message []byte)
 	onClose   OnCloseFunc
-	writing   bool
+	writing   int32
 	writeChan chan bool
 	close     bool
+	//保护conn与close,调用与关闭在不同协程中进行,复制后共用
+	lock *sync.Mutex
 }
 
 //客户端配置
@@ -24,6 +28,14 @@ type ClientConf struct {
 	Host   string
 	Path   string
 	Ticker int
+	//启用permessage-deflate压缩,小于CompressionThreshold字节的消息不压缩
+	Compression          bool
+	CompressionThreshold int
+	//单条消息最大字节数,超出时以1009关闭连接,0为不限制
+	MaxMessageSize int64
+	//读写超时,0为不限制,读超时需大于服务端心跳回复间隔
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
 }
 
 //新建客户端:配置,回调函数,断开连接时调用函数
@@ -32,38 +44,60 @@ func NewClient(conf ClientConf, callback func(message []byte), onClose OnCloseFu
 	client.conf = conf
 	client.method = callback
 	client.onClose = onClose
+	client.lock = new(sync.Mutex)
 	err := client.start()
 	return client, err
 }
 
 func (ws *WSClient) SendMessage(data []byte) error {
+	return ws.send(websocket.TextMessage, data)
+}
+
+//发送二进制消息
+func (ws *WSClient) SendBinary(data []byte) error {
+	return ws.send(websocket.BinaryMessage, data)
+}
+
+func (ws *WSClient) send(messageType int, data []byte) error {
 	defer func() {
 		recover()
 	}()
 	var err error
+	ws.lock.Lock()
 	if ws.close == false && ws.conn == nil {
 		err = ws.start()
 	}
+	conn := ws.conn
+	ws.lock.Unlock()
 	if err != nil {
 		return err
 	}
-	if ws.conn == nil {
+	if conn == nil {
 		return errors.New("client is close")
 	}
-	ws.writing = true
-	err = ws.writeMessage(data)
-	ws.writing = false
+	//并发调用时多个协程同时写入,计数代替标记
+	atomic.AddInt32(&ws.writing, 1)
+	err = ws.writeMessage(conn, messageType, data)
+	atomic.AddInt32(&ws.writing, -1)
 	return err
 }
 
-func (ws *WSClient) writeMessage(data []byte) error {
+func (ws *WSClient) writeMessage(conn *websocket.Conn, messageType int, data []byte) error {
 	ws.writeChan <- true
-	err := ws.conn.WriteMessage(websocket.TextMessage, data)
+	if ws.conf.Compression {
+		conn.EnableWriteCompression(len(data) >= ws.conf.CompressionThreshold)
+	}
+	if ws.conf.WriteTimeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(ws.conf.WriteTimeout))
+	}
+	err := conn.WriteMessage(messageType, data)
 	<-ws.writeChan
 	return err
 }
 
 func (ws *WSClient) Close() {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
 	ws.close = true
 	if ws.conn != nil {
 		ws.conn.Close()
@@ -73,21 +107,29 @@ func (ws *WSClient) Close() {
 
 func (ws *WSClient) start() error {
 	ws.close = false
-	ws.writing = false
+	atomic.StoreInt32(&ws.writing, 0)
 	ws.writeChan = make(chan bool, 1)
 	if ws.conn != nil {
 		ws.conn.Close()
 	}
 	urls := "ws://" + ws.conf.Host + ws.conf.Path
-	c, _, err := websocket.DefaultDialer.Dial(urls, nil)
+	dialer := *websocket.DefaultDialer
+	dialer.EnableCompression = ws.conf.Compression
+	c, _, err := dialer.Dial(urls, nil)
 	if err != nil {
 		return err
 	}
+	if ws.conf.MaxMessageSize > 0 {
+		c.SetReadLimit(ws.conf.MaxMessageSize)
+	}
 	ws.conn = c
 	//读取信息
 	go func() {
 		for {
-			_, m, err := ws.conn.ReadMessage()
+			if ws.conf.ReadTimeout > 0 {
+				c.SetReadDeadline(time.Now().Add(ws.conf.ReadTimeout))
+			}
+			_, m, err := c.ReadMessage()
 			if err != nil {
 				if ws.onClose != nil {
 					ws.onClose(ws, err)
@@ -100,15 +142,17 @@ func (ws *WSClient) start() error {
 		}
 	}()
 	go func() {
-		err := ws.ping(ws.conf.Ticker)
+		err := ws.ping(c, ws.conf.Ticker)
 		if err != nil {
-			ws.conn.Close()
+			c.Close()
 		}
 	}()
 	return nil
 }
 
 func (ws *WSClient) isClose() bool {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
 	return ws.close
 }
 
@@ -119,7 +163,7 @@ func isPing(msg []byte) bool {
 	return false
 }
 
-func (ws *WSClient) ping(ticket int) error {
+func (ws *WSClient) ping(conn *websocket.Conn, ticket int) error {
 	defer func() {
 		if err := recover(); err != nil {
 			log.Println(err)
@@ -132,8 +176,8 @@ func (ws *WSClient) ping(ticket int) error {
 		if ws.isClose() == true {
 			return nil
 		}
-		if !ws.writing {
-			err := ws.writeMessage([]byte(BEAT))
+		if atomic.LoadInt32(&ws.writing) == 0 {
+			err := ws.writeMessage(conn, websocket.TextMessage, []byte(BEAT))
 			if err != nil {
 				return err
 			}
@@ -0,0 +1,106 @@
+package ws_rpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+//编解码器,决定rpc帧在连接上的格式
+type Codec interface {
+	//编码名称,连接时通过参数codec协商
+	Name() string
+	//是否以二进制帧发送
+	Binary() bool
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	//明文json
+	JSONCodec Codec = jsonCodec{}
+	//旧版混淆格式(默认)
+	LegacyCodec Codec = legacyCodec{}
+	//MessagePack二进制格式
+	MsgpackCodec Codec = msgpackCodec{}
+)
+
+//默认编码,兼容旧版本
+var DefaultCodec = LegacyCodec
+
+//内置编码表
+func builtinCodecs() map[string]Codec {
+	return map[string]Codec{
+		JSONCodec.Name():    JSONCodec,
+		LegacyCodec.Name():  LegacyCodec,
+		MsgpackCodec.Name(): MsgpackCodec,
+	}
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) Binary() bool {
+	return false
+}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type legacyCodec struct{}
+
+func (legacyCodec) Name() string {
+	return "legacy"
+}
+
+func (legacyCodec) Binary() bool {
+	return false
+}
+
+func (legacyCodec) Marshal(v interface{}) ([]byte, error) {
+	return encoder(v)
+}
+
+func (legacyCodec) Unmarshal(data []byte, v interface{}) error {
+	if len(data) == 0 {
+		return errors.New("empty message")
+	}
+	return decoder(data, v)
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string {
+	return "msgpack"
+}
+
+func (msgpackCodec) Binary() bool {
+	return true
+}
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	//沿用json标签,与其他编码的字段名一致
+	enc.SetCustomStructTag("json")
+	enc.UseCompactInts(true)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(v)
+}
@@ -12,7 +12,7 @@ type Context interface {
 	Set(key string, val interface{})
 	GetFrom() map[string]string
 }
-type context struct {
+type wsContext struct {
 	response http.ResponseWriter
 	request  *http.Request
 	other    sync.Map
@@ -25,30 +25,30 @@ func NewContext(w http.ResponseWriter, r *http.Request) Context {
 	for k, v := range val {
 		get[k] = v[0]
 	}
-	return &context{
+	return &wsContext{
 		response: w,
 		request:  r,
 		GET:      get,
 	}
 }
 
-func (c *context) GetFrom() map[string]string {
+func (c *wsContext) GetFrom() map[string]string {
 	return c.GET
 }
 
-func (c *context) Request() *http.Request {
+func (c *wsContext) Request() *http.Request {
 	return c.request
 }
 
-func (c *context) Response() http.ResponseWriter {
+func (c *wsContext) Response() http.ResponseWriter {
 	return c.response
 }
 
-func (c *context) Get(key string) interface{} {
+func (c *wsContext) Get(key string) interface{} {
 	res, _ := c.other.Load(key)
 	return res
 }
 
-func (c *context) Set(key string, val interface{}) {
+func (c *wsContext) Set(key string, val interface{}) {
 	c.other.Store(key, val)
 }
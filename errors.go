@@ -0,0 +1,118 @@
+package ws_rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+//错误码,预定义部分与JSON-RPC 2.0一致
+const (
+	CodeParseError       = -32700 //帧无法解析
+	CodeInvalidRequest   = -32600 //请求无效
+	CodeNoMethod         = -32601 //方法不存在
+	CodeInvalidParams    = -32602 //参数无法解码
+	CodeInternal         = -32603 //内部错误
+	CodeNoWaiter         = -32000 //服务不存在
+	CodeTimeout          = -32001 //调用超时
+	CodeCanceled         = -32002 //调用取消
+	CodeClosed           = -32003 //连接已断开
+	CodeIncompatible     = -32004 //协议版本或参数不兼容
+	CodePermissionDenied = -32005 //无权调用
+	CodeBusy             = -32006 //处理队列已满
+	CodeUnknown          = -32099 //方法返回的普通错误
+)
+
+//rpc错误,在连接上传输并在调用方还原,可通过errors.As获取
+type RPCError struct {
+	Code      int                    `json:"code"`
+	Message   string                 `json:"message"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+	Retryable bool                   `json:"retryable,omitempty"`
+	cause     error
+}
+
+//创建rpc错误,方法返回*RPCError时调用方收到相同的错误码与详情
+func NewError(code int, message string) *RPCError {
+	return &RPCError{
+		Code:    code,
+		Message: message,
+	}
+}
+
+//创建rpc错误,格式化错误信息
+func Errorf(code int, format string, a ...interface{}) *RPCError {
+	return NewError(code, fmt.Sprintf(format, a...))
+}
+
+//附加详情
+func (e *RPCError) WithDetails(details map[string]interface{}) *RPCError {
+	e.Details = details
+	return e
+}
+
+//标记可重试
+func (e *RPCError) WithRetryable() *RPCError {
+	e.Retryable = true
+	return e
+}
+
+func (e *RPCError) Error() string {
+	return e.Message
+}
+
+//本地产生的错误可取得原因,例:errors.Is(err, context.DeadlineExceeded)
+func (e *RPCError) Unwrap() error {
+	return e.cause
+}
+
+//兼容旧版本以字符串传输的错误
+func (e *RPCError) UnmarshalJSON(data []byte) error {
+	var msg string
+	if err := json.Unmarshal(data, &msg); err == nil {
+		*e = RPCError{}
+		if msg != "" {
+			e.Code = CodeUnknown
+			e.Message = msg
+		}
+		return nil
+	}
+	type rpcError RPCError
+	return json.Unmarshal(data, (*rpcError)(e))
+}
+
+//转为rpc错误
+func toRPCError(err error) *RPCError {
+	if err == nil {
+		return nil
+	}
+	var e *RPCError
+	if errors.As(err, &e) {
+		return e
+	}
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return &RPCError{Code: CodeTimeout, Message: err.Error(), Retryable: true, cause: err}
+	case errors.Is(err, context.Canceled):
+		return &RPCError{Code: CodeCanceled, Message: err.Error(), cause: err}
+	}
+	return &RPCError{Code: CodeUnknown, Message: err.Error(), cause: err}
+}
+
+//连接已断开
+func errClosed() *RPCError {
+	return NewError(CodeClosed, "client is close").WithRetryable()
+}
+
+func errBusy() *RPCError {
+	return NewError(CodeBusy, "busy, queue is full").WithRetryable()
+}
+
+//发送失败转为rpc错误,非rpc错误视为连接已断开
+func sendError(err error) *RPCError {
+	if e, ok := err.(*RPCError); ok {
+		return e
+	}
+	return &RPCError{Code: CodeClosed, Message: err.Error(), Retryable: true, cause: err}
+}
@@ -0,0 +1,184 @@
+package ws_rpc
+
+import (
+	"encoding/json"
+	"time"
+)
+
+//协议版本,帧格式不兼容地变更时递增
+const ProtocolVersion = 1
+
+//可兼容的最低协议版本
+const MinProtocolVersion = 1
+
+//本端支持的功能
+var protocolFeatures = []string{"notify", "cancel", "batch", "stream", "flow_control", "blob"}
+
+//握手协商的连接参数
+type Handshake struct {
+	Version        int      `json:"v"`
+	Codec          string   `json:"codec,omitempty"`
+	Compression    bool     `json:"compression,omitempty"`
+	Heartbeat      int64    `json:"heartbeat,omitempty"` //心跳间隔,秒
+	MaxMessageSize int64    `json:"max_size,omitempty"`  //单条消息最大字节数,0为不限制
+	Features       []string `json:"features,omitempty"`
+}
+
+//是否支持该功能
+func (h *Handshake) HasFeature(name string) bool {
+	if h == nil {
+		return false
+	}
+	for _, f := range h.Features {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+//握手帧,客户端连接后发送hello,服务端回复welcome,固定使用json文本帧
+type helloData struct {
+	Type string `json:"t"`
+	Handshake
+	Err *RPCError `json:"err,omitempty"` //不兼容时的原因
+}
+
+func createHelloData(typ string, h Handshake, err error) ([]byte, error) {
+	d := helloData{
+		Type:      typ,
+		Handshake: h,
+		Err:       toRPCError(err),
+	}
+	return json.Marshal(&d)
+}
+
+func isHelloWsFunc(msg []byte, typ string) (*helloData, bool) {
+	if len(msg) == 0 || msg[0] != '{' {
+		return nil, false
+	}
+	res := new(helloData)
+	if err := json.Unmarshal(msg, res); err != nil {
+		return nil, false
+	}
+	if res.Type != typ {
+		return nil, false
+	}
+	return res, true
+}
+
+//双方都支持的功能
+func intersectFeatures(a, b []string) []string {
+	res := make([]string, 0, len(a))
+	for _, f := range a {
+		for _, g := range b {
+			if f == g {
+				res = append(res, f)
+				break
+			}
+		}
+	}
+	return res
+}
+
+//服务端处理hello,返回协商结果,不兼容时返回错误
+func (ws *wsMethod) negotiate(client *Client, hello *helloData) (Handshake, error) {
+	h := Handshake{
+		Version:        ProtocolVersion,
+		Codec:          client.codec.Name(),
+		Compression:    client.conf.Compression && hello.Compression,
+		Heartbeat:      client.conf.Ticker,
+		MaxMessageSize: client.conf.MaxMessageSize,
+		Features:       intersectFeatures(protocolFeatures, hello.Features),
+	}
+	if hello.Version < MinProtocolVersion {
+		return h, Errorf(CodeIncompatible, "unsupported protocol version %d, server supports %d-%d",
+			hello.Version, MinProtocolVersion, ProtocolVersion)
+	}
+	if hello.Version < h.Version {
+		h.Version = hello.Version
+	}
+	if hello.Codec != "" {
+		if _, ok := ws.codecs[hello.Codec]; !ok {
+			return h, Errorf(CodeIncompatible, "unsupported codec %s", hello.Codec)
+		}
+		//编码在连接时由参数codec确定,握手中不再修改,避免与发送协程竞争
+		if hello.Codec != client.codec.Name() {
+			return h, Errorf(CodeIncompatible, "codec %s does not match connection codec %s", hello.Codec, client.codec.Name())
+		}
+	}
+	return h, nil
+}
+
+//服务端回复握手,不兼容时回复原因后断开
+func (ws *wsMethod) onHello(client *Client, hello *helloData) {
+	h, err := ws.negotiate(client, hello)
+	m, e := createHelloData("welcome", h, err)
+	if e != nil {
+		return
+	}
+	client.SendMsg(m)
+	if err != nil {
+		client.Close()
+		return
+	}
+	//MaxMessageSize记录客户端的上限,向客户端发送时按此检查
+	peer := h
+	peer.MaxMessageSize = hello.MaxMessageSize
+	client.peer.Store(&peer)
+}
+
+//连接协商的参数,MaxMessageSize为客户端的上限,客户端未握手时为nil
+func (c *Client) Handshake() *Handshake {
+	if c == nil {
+		return nil
+	}
+	return c.peer.Load()
+}
+
+//客户端发送hello并等待服务端回复,不兼容时返回错误
+//服务端不支持握手,等待超时后按旧协议通信,此时只能使用LegacyCodec
+func (w *WSRpcClient) handshake() error {
+	if w.handshakeWait <= 0 {
+		return nil
+	}
+	h := Handshake{
+		Version:        ProtocolVersion,
+		Codec:          w.codec.Name(),
+		Compression:    w.conf.Compression,
+		Heartbeat:      int64(w.conf.Ticker),
+		MaxMessageSize: w.conf.MaxMessageSize,
+		Features:       protocolFeatures,
+	}
+	m, err := createHelloData("hello", h, nil)
+	if err != nil {
+		return err
+	}
+	if err = w.client.SendMessage(m); err != nil {
+		return sendError(err)
+	}
+	select {
+	case welcome := <-w.welcome:
+		if welcome.Err != nil && (welcome.Err.Code != 0 || welcome.Err.Message != "") {
+			return welcome.Err
+		}
+		if welcome.Version < MinProtocolVersion || welcome.Version > ProtocolVersion {
+			return Errorf(CodeIncompatible, "unsupported protocol version %d, client supports %d-%d",
+				welcome.Version, MinProtocolVersion, ProtocolVersion)
+		}
+		if welcome.Codec != w.codec.Name() {
+			return Errorf(CodeIncompatible, "server chose codec %s, want %s", welcome.Codec, w.codec.Name())
+		}
+		return nil
+	case <-time.After(w.handshakeWait):
+		if w.codec != LegacyCodec {
+			return Errorf(CodeIncompatible, "handshake timeout, server without protocol handshake only supports codec %s", LegacyCodec.Name())
+		}
+		return nil
+	}
+}
+
+//与服务端协商的参数,未握手时为nil
+func (w *WSRpcClient) Handshake() *Handshake {
+	return w.peer.Load()
+}
@@ -0,0 +1,143 @@
+package ws_rpc
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+//单次调用的信息,拦截器可修改In
+type CallInfo struct {
+	Waiter string
+	Method string
+	In     interface{}
+	Client *Client //服务端为调用所在的连接,客户端为nil
+	Notify bool    //通知,不等待回复
+	Start  time.Time
+}
+
+//执行调用
+type UnaryHandler func(ctx context.Context, info *CallInfo) (interface{}, error)
+
+//拦截器,调用next继续执行,可在前后记录日志,统计耗时,校验参数或直接返回错误
+type UnaryInterceptor func(ctx context.Context, info *CallInfo, next UnaryHandler) (interface{}, error)
+
+//按注册顺序由外到内执行拦截器,最后执行handler
+func intercept(ctx context.Context, list []UnaryInterceptor, info *CallInfo, handler UnaryHandler) (interface{}, error) {
+	if len(list) == 0 {
+		return handler(ctx, info)
+	}
+	return list[0](ctx, info, func(ctx context.Context, info *CallInfo) (interface{}, error) {
+		return intercept(ctx, list[1:], info, handler)
+	})
+}
+
+//批量调用中到达最内层的一项
+type batchItem struct {
+	call BatchCall
+	back chan BatchResult
+}
+
+//批量调用的每一项分别经过拦截器,到达最内层的项合并为一帧由send发送,拦截器直接返回的项不发送
+//所有项均已到达最内层或已返回后才发送,之后再次调用next的项单独发送
+func interceptBatch(ctx context.Context, list []UnaryInterceptor, client *Client, calls []BatchCall,
+	send func(ctx context.Context, calls []BatchCall) ([]BatchResult, error)) ([]BatchResult, error) {
+	if len(list) == 0 {
+		return send(ctx, calls)
+	}
+	var lock sync.Mutex
+	var reached []*batchItem
+	sent := false
+	events := make(chan struct{}, len(calls)) //每项到达最内层或返回时通知一次
+	results := make([]BatchResult, len(calls))
+	wg := sync.WaitGroup{}
+	for i, call := range calls {
+		wg.Add(1)
+		go func(i int, call BatchCall) {
+			defer wg.Done()
+			once := sync.Once{}
+			signal := func() {
+				once.Do(func() { events <- struct{}{} })
+			}
+			info := newCallInfo(client, call.Waiter, call.Method, call.In, false)
+			out, err := intercept(ctx, list, info, func(ctx context.Context, info *CallInfo) (interface{}, error) {
+				item := &batchItem{
+					call: BatchCall{Waiter: info.Waiter, Method: info.Method, In: info.In},
+					back: make(chan BatchResult, 1),
+				}
+				lock.Lock()
+				if sent {
+					lock.Unlock()
+					res, err := send(ctx, []BatchCall{item.call})
+					if err != nil {
+						return nil, err
+					}
+					return res[0].Out, res[0].Err
+				}
+				reached = append(reached, item)
+				lock.Unlock()
+				signal()
+				r := <-item.back
+				return r.Out, r.Err
+			})
+			results[i] = BatchResult{Out: out, Err: err}
+			signal()
+		}(i, call)
+	}
+	for range calls {
+		<-events
+	}
+	lock.Lock()
+	sent = true
+	items := reached
+	lock.Unlock()
+	var err error
+	if len(items) > 0 {
+		batch := make([]BatchCall, len(items))
+		for i, item := range items {
+			batch[i] = item.call
+		}
+		var res []BatchResult
+		res, err = send(ctx, batch)
+		for i, item := range items {
+			if err != nil {
+				item.back <- BatchResult{Err: err}
+			} else {
+				item.back <- res[i]
+			}
+		}
+	}
+	wg.Wait()
+	if err != nil {
+		//超时或断开时整批失败
+		return nil, err
+	}
+	return results, nil
+}
+
+func newCallInfo(client *Client, waiter, method string, in interface{}, notify bool) *CallInfo {
+	return &CallInfo{
+		Waiter: waiter,
+		Method: method,
+		In:     in,
+		Client: client,
+		Notify: notify,
+		Start:  time.Now(),
+	}
+}
+
+//拦截客户端发起的调用与通知,批量调用的每一项分别经过拦截器,流式调用不经过拦截器
+func (s *WsServerConf) UnaryInterceptorFunc(interceptors ...UnaryInterceptor) {
+	s.interceptors = append(s.interceptors, interceptors...)
+}
+
+//拦截服务端向客户端发起的调用与通知,即CallClientFunc,NotifyClient,CallClientBatch等,批量调用的每一项分别拦截
+func (s *WsServerConf) ClientCallInterceptorFunc(interceptors ...UnaryInterceptor) {
+	s.callInterceptors = append(s.callInterceptors, interceptors...)
+}
+
+//拦截向服务端发起的调用与通知,即CallFunc,Notify,CallBatch等,批量调用的每一项分别拦截
+func (w *WSRpcClient) CallInterceptorFunc(interceptors ...UnaryInterceptor) *WSRpcClient {
+	w.interceptors = append(w.interceptors, interceptors...)
+	return w
+}
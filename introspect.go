@@ -0,0 +1,304 @@
+package ws_rpc
+
+import (
+	"context"
+	"encoding"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+//内置的服务描述服务名,服务端自动注册,客户端通过EnableReflection注册
+//list 返回所有服务,describe 按服务名返回单个服务,本服务不在列表中
+const ReflectionWaiter = "reflection"
+
+//服务描述
+type ServiceInfo struct {
+	Name    string       `json:"name"`
+	Methods []MethodInfo `json:"methods"`
+}
+
+//方法描述
+type MethodInfo struct {
+	Name   string    `json:"name"`
+	In     *TypeInfo `json:"in,omitempty"`  //参数类型,为空时无参数
+	Out    *TypeInfo `json:"out,omitempty"` //返回值类型,为空时只返回error
+	Stream bool      `json:"stream,omitempty"`
+	Client bool      `json:"client,omitempty"` //接收*Client参数,只能由客户端调用服务端
+}
+
+//类型描述,按json编码后的形式
+//kind: bool,int,uint,float,string,bytes,time,array,map,object,any
+type TypeInfo struct {
+	Kind     string      `json:"kind"`
+	Name     string      `json:"name,omitempty"` //自定义类型的Go类型名,如 main.AddReq
+	Nullable bool        `json:"nullable,omitempty"`
+	Elem     *TypeInfo   `json:"elem,omitempty"` //数组元素或map值的类型
+	Key      *TypeInfo   `json:"key,omitempty"`  //map键的类型
+	Fields   []FieldInfo `json:"fields,omitempty"`
+	Ref      bool        `json:"ref,omitempty"` //递归引用外层的同名类型,字段见外层
+}
+
+//结构体字段描述
+type FieldInfo struct {
+	Name     string    `json:"name"` //json字段名
+	Type     *TypeInfo `json:"type"`
+	Optional bool      `json:"optional,omitempty"` //omitempty
+}
+
+var (
+	timeType          = reflect.TypeOf(time.Time{})
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+//由Go类型生成描述
+func describeType(t reflect.Type) *TypeInfo {
+	return typeDescriber{seen: make(map[reflect.Type]bool)}.describe(t)
+}
+
+type typeDescriber struct {
+	seen map[reflect.Type]bool //正在描述的结构体,用于处理递归类型
+}
+
+func (d typeDescriber) describe(t reflect.Type) *TypeInfo {
+	nullable := false
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+		nullable = true
+	}
+	info := &TypeInfo{Name: typeName(t), Nullable: nullable}
+	switch {
+	case t == timeType:
+		info.Kind = "time"
+		return info
+	case t.Implements(jsonMarshalerType) || reflect.PtrTo(t).Implements(jsonMarshalerType):
+		//自定义编码,无法得知编码后的形式
+		info.Kind = "any"
+		return info
+	case t.Kind() != reflect.String && (t.Implements(textMarshalerType) || reflect.PtrTo(t).Implements(textMarshalerType)):
+		info.Kind = "string"
+		return info
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		info.Kind = "bool"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		info.Kind = "int"
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		info.Kind = "uint"
+	case reflect.Float32, reflect.Float64:
+		info.Kind = "float"
+	case reflect.String:
+		info.Kind = "string"
+	case reflect.Slice, reflect.Array:
+		//json只将[]byte编码为base64字符串,[N]byte为数字数组
+		if t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8 {
+			info.Kind = "bytes"
+			break
+		}
+		info.Kind = "array"
+		info.Nullable = info.Nullable || t.Kind() == reflect.Slice
+		info.Elem = d.describe(t.Elem())
+	case reflect.Map:
+		info.Kind = "map"
+		info.Nullable = true
+		info.Key = d.describe(t.Key())
+		info.Elem = d.describe(t.Elem())
+	case reflect.Struct:
+		info.Kind = "object"
+		if d.seen[t] {
+			info.Ref = true
+			return info
+		}
+		d.seen[t] = true
+		info.Fields = d.fields(t)
+		delete(d.seen, t)
+	default:
+		info.Kind = "any"
+	}
+	return info
+}
+
+//按json规则列出字段,匿名结构体字段展开
+func (d typeDescriber) fields(t reflect.Type) []FieldInfo {
+	list := jsonFields(t)
+	res := make([]FieldInfo, 0, len(list))
+	for _, f := range list {
+		field := FieldInfo{Name: f.name, Type: d.describe(f.typ), Optional: f.omitEmpty}
+		if f.quoted {
+			field.Type.Kind = "string"
+		}
+		res = append(res, field)
+	}
+	return res
+}
+
+//结构体按json编码后的字段
+type jsonField struct {
+	name      string
+	typ       reflect.Type
+	omitEmpty bool //omitempty
+	quoted    bool //string选项,数字与布尔值编码为字符串
+}
+
+func jsonFields(t reflect.Type) []jsonField {
+	res := make([]jsonField, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				res = append(res, jsonFields(ft)...)
+				continue
+			}
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		opts = "," + opts + ","
+		res = append(res, jsonField{
+			name:      name,
+			typ:       f.Type,
+			omitEmpty: strings.Contains(opts, ",omitempty,"),
+			quoted:    strings.Contains(opts, ",string,"),
+		})
+	}
+	return res
+}
+
+//自定义类型的名称,内置与匿名类型为空
+func typeName(t reflect.Type) string {
+	if t.Name() == "" || t.PkgPath() == "" {
+		return ""
+	}
+	return t.String()
+}
+
+func (m *waiterMethod) describe(name string) MethodInfo {
+	info := MethodInfo{Name: name, Stream: m.stream, Client: m.client}
+	if m.in != nil {
+		info.In = describeType(m.in)
+	}
+	if m.out != nil {
+		info.Out = describeType(m.out)
+	}
+	return info
+}
+
+//描述服务的方法,按调用名排序,visible不为nil时只包含可见的方法
+func (w *Waiter) describe(name string, visible func(waiter, method string) bool) ServiceInfo {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+	info := ServiceInfo{Name: name, Methods: make([]MethodInfo, 0, len(w.methods))}
+	for call, m := range w.methods {
+		if visible == nil || visible(name, call) {
+			info.Methods = append(info.Methods, m.describe(call))
+		}
+	}
+	sort.Slice(info.Methods, func(i, j int) bool {
+		return info.Methods[i].Name < info.Methods[j].Name
+	})
+	return info
+}
+
+//描述所有服务,按服务名排序,不含服务描述服务本身,visible不为nil时只包含可见的服务与方法
+func (t *waiterTable) describe(visible func(waiter, method string) bool) []ServiceInfo {
+	t.lock.RLock()
+	names := make([]string, 0, len(t.waiters))
+	waiters := make(map[string]*Waiter, len(t.waiters))
+	for name, w := range t.waiters {
+		if name == ReflectionWaiter || visible != nil && !visible(name, "") {
+			continue
+		}
+		names = append(names, name)
+		waiters[name] = w
+	}
+	t.lock.RUnlock()
+	sort.Strings(names)
+	res := make([]ServiceInfo, 0, len(names))
+	for _, name := range names {
+		res = append(res, waiters[name].describe(name, visible))
+	}
+	return res
+}
+
+//描述单个服务,不可见时与不存在相同
+func (t *waiterTable) describeOne(name string, visible func(waiter, method string) bool) (ServiceInfo, error) {
+	name = stringToLower(name)
+	if name != ReflectionWaiter && (visible == nil || visible(name, "")) {
+		if w, ok := t.get(name); ok {
+			return w.describe(name, visible), nil
+		}
+	}
+	return ServiceInfo{}, NewError(CodeNoWaiter, "no waiter")
+}
+
+//注册服务描述服务,policies不为nil时按调用方的权限过滤服务与方法
+func (t *waiterTable) registerReflection(policies *policyTable) {
+	t.remove(ReflectionWaiter, "")
+	if policies == nil {
+		t.addFunc(ReflectionWaiter, "list", func() ([]ServiceInfo, error) {
+			return t.describe(nil), nil
+		}, true)
+		t.addFunc(ReflectionWaiter, "describe", func(name string) (ServiceInfo, error) {
+			return t.describeOne(name, nil)
+		}, true)
+		return
+	}
+	t.addFunc(ReflectionWaiter, "list", func(c *Client) ([]ServiceInfo, error) {
+		return t.describe(policies.visible(c)), nil
+	}, false)
+	t.addFunc(ReflectionWaiter, "describe", func(c *Client, name string) (ServiceInfo, error) {
+		return t.describeOne(name, policies.visible(c))
+	}, false)
+}
+
+//本端注册的所有服务
+func (s *WsServerConf) Services() []ServiceInfo {
+	return s.waiter.describe(nil)
+}
+
+//本端注册的所有服务
+func (w *WSRpcClient) Services() []ServiceInfo {
+	return w.waiter.describe(nil)
+}
+
+//注册服务描述服务,服务端可通过ListClientServices查询本客户端的服务
+func (w *WSRpcClient) EnableReflection() *WSRpcClient {
+	w.waiter.registerReflection(nil)
+	return w
+}
+
+//查询服务端的所有服务
+func (w *WSRpcClient) ListServices(ctx context.Context) ([]ServiceInfo, error) {
+	return CallContext[interface{}, []ServiceInfo](ctx, w, ReflectionWaiter, "list", nil)
+}
+
+//查询服务端的单个服务
+func (w *WSRpcClient) DescribeService(ctx context.Context, waiter string) (ServiceInfo, error) {
+	return CallContext[string, ServiceInfo](ctx, w, ReflectionWaiter, "describe", waiter)
+}
+
+//查询客户端的所有服务,客户端未启用EnableReflection时返回CodeNoWaiter错误
+func ListClientServices(ctx context.Context, client *Client) ([]ServiceInfo, error) {
+	return CallClientContext[interface{}, []ServiceInfo](ctx, client, ReflectionWaiter, "list", nil)
+}
+
+//查询客户端的单个服务
+func DescribeClientService(ctx context.Context, client *Client, waiter string) (ServiceInfo, error) {
+	return CallClientContext[string, ServiceInfo](ctx, client, ReflectionWaiter, "describe", waiter)
+}
@@ -0,0 +1,341 @@
+package ws_rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+//JSON-RPC 2.0兼容模式,客户端以此子协议连接,或带参数protocol=jsonrpc2.0
+//方法名为 waiter.method,连接上的消息均为标准JSON-RPC文本帧
+const JSONRPCProtocol = "jsonrpc2.0"
+
+//JSON-RPC 2.0消息,请求,通知与回复共用
+type jsonrpcMessage struct {
+	Version string           `json:"jsonrpc"`
+	Method  string           `json:"method,omitempty"`
+	Params  json.RawMessage  `json:"params,omitempty"`
+	Result  *json.RawMessage `json:"result,omitempty"`
+	Error   *jsonrpcError    `json:"error,omitempty"`
+	Id      json.RawMessage  `json:"id,omitempty"` //为空时是通知
+}
+
+type jsonrpcError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+func newJSONRPCError(err error) *jsonrpcError {
+	e := toRPCError(err)
+	r := &jsonrpcError{Code: e.Code, Message: e.Message}
+	if len(e.Details) > 0 {
+		r.Data = e.Details
+	}
+	return r
+}
+
+func (e *jsonrpcError) rpcError() *RPCError {
+	r := &RPCError{Code: e.Code, Message: e.Message}
+	if data, ok := e.Data.(map[string]interface{}); ok {
+		r.Details = data
+	}
+	return r
+}
+
+//创建回复,id为null时表示无法解析请求id
+func createJSONRPCResult(id json.RawMessage, out interface{}, err error) *jsonrpcMessage {
+	if len(id) == 0 {
+		id = json.RawMessage("null")
+	}
+	r := &jsonrpcMessage{Version: "2.0", Id: id}
+	if err != nil {
+		r.Error = newJSONRPCError(err)
+		return r
+	}
+	b, err := json.Marshal(out)
+	if err != nil {
+		r.Error = newJSONRPCError(Errorf(CodeInternal, "encode result: %s", err))
+		return r
+	}
+	raw := json.RawMessage(b)
+	r.Result = &raw
+	return r
+}
+
+//创建发往客户端的请求,id为空时为通知
+func createJSONRPCRequest(waiter, method, id string, in interface{}) (*jsonrpcMessage, error) {
+	r := &jsonrpcMessage{
+		Version: "2.0",
+		Method:  stringToLower(waiter) + "." + method,
+	}
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return nil, err
+		}
+		//params只能为对象或数组,其余类型按位置参数发送
+		if b[0] != '{' && b[0] != '[' {
+			b = append(append([]byte("["), b...), ']')
+		}
+		r.Params = b
+	}
+	if id != "" {
+		b, _ := json.Marshal(id)
+		r.Id = b
+	}
+	return r, nil
+}
+
+//解析params,对象按名传入,只有一项的数组取该项
+func decodeJSONRPCParams(params json.RawMessage) (interface{}, error) {
+	params = bytes.TrimSpace(params)
+	if len(params) == 0 || string(params) == "null" {
+		return nil, nil
+	}
+	if params[0] != '{' && params[0] != '[' {
+		return nil, NewError(CodeInvalidRequest, "params must be object or array")
+	}
+	var in interface{}
+	if err := json.Unmarshal(params, &in); err != nil {
+		return nil, Errorf(CodeInvalidParams, "invalid params: %s", err)
+	}
+	if list, ok := in.([]interface{}); ok && len(list) == 1 {
+		return list[0], nil
+	}
+	return in, nil
+}
+
+//拆分方法名 waiter.method
+func splitJSONRPCMethod(name string) (string, string, bool) {
+	i := strings.Index(name, ".")
+	if i <= 0 || i == len(name)-1 {
+		return "", "", false
+	}
+	return name[:i], name[i+1:], true
+}
+
+func sendJSONRPC(client *Client, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	client.SendMsg(b)
+}
+
+//收到JSON-RPC消息时处理,数组为批量请求,各项并发执行,并发数不超过处理池的Workers,回复按数组返回
+func (ws *wsMethod) onJSONRPC(client *Client, msg []byte) {
+	msg = bytes.TrimSpace(msg)
+	if len(msg) == 0 || msg[0] != '[' {
+		if r := ws.handleJSONRPC(client, msg); r != nil {
+			sendJSONRPC(client, r)
+		}
+		return
+	}
+	var items []json.RawMessage
+	if err := json.Unmarshal(msg, &items); err != nil {
+		sendJSONRPC(client, createJSONRPCResult(nil, nil, NewError(CodeParseError, "parse error")))
+		return
+	}
+	if len(items) == 0 {
+		sendJSONRPC(client, createJSONRPCResult(nil, nil, NewError(CodeInvalidRequest, "empty batch")))
+		return
+	}
+	replies := make([]*jsonrpcMessage, len(items))
+	runLimited(len(items), client.limit(), func(i int) {
+		replies[i] = ws.handleJSONRPC(client, items[i])
+	})
+	out := make([]*jsonrpcMessage, 0, len(replies))
+	for _, r := range replies {
+		if r != nil {
+			out = append(out, r)
+		}
+	}
+	//全部为通知或回复时不发送
+	if len(out) > 0 {
+		sendJSONRPC(client, out)
+	}
+}
+
+//在读取协程中处理客户端的回复,其余消息投递到处理池,队列满时请求按策略回复CodeBusy错误或丢弃
+func (ws *wsMethod) orderedJSONRPC(client *Client, msg []byte) bool {
+	if isHeartbeat(msg) {
+		return false
+	}
+	msg = bytes.TrimSpace(msg)
+	batch := len(msg) > 0 && msg[0] == '['
+	if !batch && isJSONRPCReply(msg) {
+		ws.handleJSONRPC(client, msg)
+		return true
+	}
+	var items []json.RawMessage
+	if batch && json.Unmarshal(msg, &items) == nil && len(items) > 0 {
+		//批量中的回复立即处理,请求与无效项仍按批量处理
+		requests := make([]json.RawMessage, 0, len(items))
+		for _, item := range items {
+			if isJSONRPCReply(item) {
+				ws.handleJSONRPC(client, item)
+			} else {
+				requests = append(requests, item)
+			}
+		}
+		if len(requests) == 0 {
+			return true
+		}
+		if len(requests) < len(items) {
+			msg, _ = json.Marshal(requests)
+		}
+		items = requests
+	} else {
+		items = []json.RawMessage{msg}
+	}
+	if policy, ok := client.submit(func() { ws.onJSONRPC(client, msg) }); !ok && policy == OverflowReject {
+		ws.rejectJSONRPC(client, items, batch)
+	}
+	return true
+}
+
+//有result或error且没有method时为客户端的回复
+func isJSONRPCReply(msg []byte) bool {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(msg, &fields); err != nil {
+		return false
+	}
+	_, method := fields["method"]
+	_, result := fields["result"]
+	_, e := fields["error"]
+	return !method && (result || e)
+}
+
+//处理一条消息,通知与客户端的回复返回nil
+func (ws *wsMethod) handleJSONRPC(client *Client, msg []byte) *jsonrpcMessage {
+	m := new(jsonrpcMessage)
+	if err := json.Unmarshal(msg, m); err != nil {
+		if json.Valid(msg) {
+			return createJSONRPCResult(nil, nil, NewError(CodeInvalidRequest, "invalid request"))
+		}
+		return createJSONRPCResult(nil, nil, NewError(CodeParseError, "parse error"))
+	}
+	if m.Version != "2.0" {
+		return createJSONRPCResult(m.Id, nil, NewError(CodeInvalidRequest, "invalid request"))
+	}
+	if m.Method == "" {
+		if m.Result == nil && m.Error == nil {
+			//result为null时解码后同样为nil,按是否有该字段判断
+			var fields map[string]json.RawMessage
+			json.Unmarshal(msg, &fields)
+			raw, ok := fields["result"]
+			if !ok {
+				return createJSONRPCResult(m.Id, nil, NewError(CodeInvalidRequest, "invalid request"))
+			}
+			m.Result = &raw
+		}
+		//服务端调用客户端的回复
+		var id string
+		if err := json.Unmarshal(m.Id, &id); err == nil {
+			res := &resultData{}
+			if m.Error != nil {
+				res.Err = m.Error.rpcError()
+			} else if err := json.Unmarshal(*m.Result, &res.Out); err != nil {
+				res.Err = Errorf(CodeParseError, "parse result: %s", err)
+			}
+			client.calls.done(id, res)
+		}
+		return nil
+	}
+	call := &callData{Method: m.Method, notify: len(m.Id) == 0}
+	waiter, method, ok := splitJSONRPCMethod(m.Method)
+	var err error
+	if ok {
+		call.Waiter, call.Method = stringToLower(waiter), method
+		call.In, err = decodeJSONRPCParams(m.Params)
+	} else {
+		err = NewError(CodeNoMethod, "method must be waiter.method")
+	}
+	if call.notify {
+		if err == nil {
+			ws.invoke(context.Background(), client, call, nil)
+		}
+		return nil
+	}
+	if err != nil {
+		return createJSONRPCResult(m.Id, nil, err)
+	}
+	ctx, done := client.running.add(nextId())
+	defer done()
+	out, err := ws.invoke(ctx, client, call, nil)
+	return createJSONRPCResult(m.Id, out, err)
+}
+
+//处理队列已满时,带id的请求回复CodeBusy错误,通知与无法解析的消息丢弃
+func (ws *wsMethod) rejectJSONRPC(client *Client, items []json.RawMessage, batch bool) {
+	replies := make([]*jsonrpcMessage, 0, len(items))
+	for _, item := range items {
+		m := new(jsonrpcMessage)
+		if err := json.Unmarshal(item, m); err != nil {
+			continue
+		}
+		if m.Method != "" && len(m.Id) > 0 {
+			replies = append(replies, createJSONRPCResult(m.Id, nil, errBusy()))
+		}
+	}
+	if len(replies) == 0 {
+		return
+	}
+	if batch {
+		sendJSONRPC(client, replies)
+	} else {
+		sendJSONRPC(client, replies[0])
+	}
+}
+
+//以JSON-RPC请求调用客户端方法,不支持取消,ctx结束时只停止等待
+func callClientJSONRPC(ctx context.Context, client *Client, waiter, method string, in interface{}) (interface{}, error) {
+	id, back := client.calls.add()
+	defer client.calls.remove(id)
+	req, err := createJSONRPCRequest(waiter, method, id, in)
+	if err != nil {
+		return nil, err
+	}
+	sendJSONRPC(client, req)
+	return waitResult(ctx, back, func() {})
+}
+
+//以JSON-RPC通知调用客户端方法
+func notifyClientJSONRPC(client *Client, waiter, method string, in interface{}) error {
+	req, err := createJSONRPCRequest(waiter, method, "", in)
+	if err != nil {
+		return err
+	}
+	sendJSONRPC(client, req)
+	return nil
+}
+
+//以JSON-RPC批量请求调用客户端方法,各项按id分别等待,sequential由客户端自行决定
+func callClientJSONRPCBatch(ctx context.Context, client *Client, calls []BatchCall) ([]BatchResult, error) {
+	reqs := make([]*jsonrpcMessage, len(calls))
+	backs := make([]chan *resultData, len(calls))
+	for i, call := range calls {
+		id, back := client.calls.add()
+		defer client.calls.remove(id)
+		req, err := createJSONRPCRequest(call.Waiter, call.Method, id, call.In)
+		if err != nil {
+			return nil, err
+		}
+		reqs[i], backs[i] = req, back
+	}
+	sendJSONRPC(client, reqs)
+	out := make([]BatchResult, len(calls))
+	for i, back := range backs {
+		v, err := waitResult(ctx, back, func() {})
+		//超时或断开时整批失败,其余为单项错误
+		var e *RPCError
+		if err != nil && (ctx.Err() != nil || errors.As(err, &e) && e.Code == CodeClosed) {
+			return nil, err
+		}
+		out[i] = BatchResult{Out: v, Err: err}
+	}
+	return out, nil
+}
@@ -18,6 +18,8 @@ type ClientManager struct {
 	unregister chan *Client
 	//在线连接数
 	online int64
+	//所有连接共用的消息处理池
+	pool *workerPool
 }
 
 //New WS管理器
@@ -35,6 +37,11 @@ func NewManager(t int64) *ClientManager {
 	return manager
 }
 
+//所有连接共用的消息并发处理限制,需在接受连接前设置
+func (manager *ClientManager) SetWorkers(conf WorkerConf) {
+	manager.pool = newWorkerPool(conf)
+}
+
 //心跳检测 每秒遍历一次
 func (manager *ClientManager) beat(t int64) {
 	ticker := time.NewTicker(time.Duration(t+1) * time.Second)
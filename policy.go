@@ -0,0 +1,150 @@
+package ws_rpc
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+//调用权限策略,返回false时拒绝调用,方法不会执行
+type Policy func(c *Client) bool
+
+//用户信息中key的值为values之一,值为切片时包含其一即可
+func RequireClaim(key string, values ...interface{}) Policy {
+	return func(c *Client) bool {
+		v, ok := c.GetUserInfo()[key]
+		if !ok {
+			return false
+		}
+		if len(values) == 0 {
+			return true
+		}
+		rv := reflect.ValueOf(v)
+		if rv.Kind() == reflect.Slice || rv.Kind() == reflect.Array {
+			for i := 0; i < rv.Len(); i++ {
+				if claimIn(rv.Index(i).Interface(), values) {
+					return true
+				}
+			}
+			return false
+		}
+		return claimIn(v, values)
+	}
+}
+
+//用户信息中role或roles包含角色之一
+func RequireRole(roles ...string) Policy {
+	values := make([]interface{}, len(roles))
+	for i, role := range roles {
+		values[i] = role
+	}
+	return AnyOf(RequireClaim("role", values...), RequireClaim("roles", values...))
+}
+
+//连接的Context满足条件,如校验连接参数与中间件设置的值
+func RequireContext(fn func(ctx Context) bool) Policy {
+	return func(c *Client) bool {
+		return c.Context != nil && fn(c.Context)
+	}
+}
+
+//用户主键的值在列表中,主键由SetUserInfo指定
+func AllowUids(uids ...interface{}) Policy {
+	return func(c *Client) bool {
+		if c.userPrimary == "" {
+			return false
+		}
+		uid, ok := c.GetUserInfo()[c.userPrimary]
+		return ok && claimIn(uid, uids)
+	}
+}
+
+//满足任一策略即可
+func AnyOf(policies ...Policy) Policy {
+	return func(c *Client) bool {
+		for _, p := range policies {
+			if p(c) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+//按字符串形式比较,用户信息中的数字可能为int,int64或float64
+func claimIn(v interface{}, values []interface{}) bool {
+	s := fmt.Sprint(v)
+	for _, value := range values {
+		if fmt.Sprint(value) == s {
+			return true
+		}
+	}
+	return false
+}
+
+//权限策略表,服务名或 服务名.调用名-->策略,均为注册时的名称
+type policyTable struct {
+	lock     sync.RWMutex
+	policies map[string][]Policy
+}
+
+func newPolicyTable() *policyTable {
+	return &policyTable{policies: make(map[string][]Policy)}
+}
+
+func policyKey(waiter, method string) string {
+	if method == "" {
+		return waiter
+	}
+	return waiter + "." + method
+}
+
+func (t *policyTable) add(waiter, method string, policies []Policy) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	key := policyKey(waiter, method)
+	t.policies[key] = append(t.policies[key], policies...)
+}
+
+//服务与方法的策略均需满足,不满足时返回CodePermissionDenied错误,method为空时只检查服务的策略
+func (t *policyTable) check(c *Client, waiter, method string) error {
+	t.lock.RLock()
+	list := append([]Policy(nil), t.policies[policyKey(waiter, "")]...)
+	if method != "" {
+		list = append(list, t.policies[policyKey(waiter, method)]...)
+	}
+	t.lock.RUnlock()
+	for _, p := range list {
+		if !p(c) {
+			return NewError(CodePermissionDenied, "permission denied").
+				WithDetails(map[string]interface{}{"waiter": waiter, "method": method})
+		}
+	}
+	return nil
+}
+
+//设置服务或方法的权限策略,method为空时作用于整个服务,多次设置时均需满足,可在启动后调用
+//需在注册服务后设置,method可为调用名或Go方法名,服务或方法不存在时返回错误,不会留下未受保护的方法
+func (s *WsServerConf) SetPolicy(waiter, method string, policies ...Policy) error {
+	name := stringToLower(waiter)
+	w, ok := s.waiter.get(name)
+	if !ok {
+		return fmt.Errorf("waiter %s is not registered", waiter)
+	}
+	if method != "" {
+		call, ok := w.callName(method)
+		if !ok {
+			return fmt.Errorf("method %s.%s is not registered", waiter, method)
+		}
+		method = call
+	}
+	s.policies.add(name, method, policies)
+	return nil
+}
+
+//客户端可见的服务与方法,用于服务描述
+func (t *policyTable) visible(c *Client) func(waiter, method string) bool {
+	return func(waiter, method string) bool {
+		return t.check(c, waiter, method) == nil
+	}
+}
@@ -0,0 +1,148 @@
+package ws_rpc
+
+import "sync"
+
+//处理队列已满时的策略
+type OverflowPolicy int
+
+const (
+	OverflowReject OverflowPolicy = iota //拒绝,调用方立即收到CodeBusy错误
+	OverflowBlock                        //暂停读取连接,直到有空位
+	OverflowDrop                         //丢弃,调用方等待至超时
+)
+
+//收到消息的并发处理限制
+type WorkerConf struct {
+	Workers  int //同时处理的消息数,0为不限制
+	Queue    int //等待处理的消息数,超出时按Overflow处理
+	Overflow OverflowPolicy
+}
+
+//有界的消息处理池
+type workerPool struct {
+	overflow OverflowPolicy
+	slots    chan struct{} //处理中与等待中的消息
+	workers  chan struct{} //处理中的消息
+}
+
+//Workers为0时返回nil,不限制
+func newWorkerPool(conf WorkerConf) *workerPool {
+	if conf.Workers <= 0 {
+		return nil
+	}
+	if conf.Queue < 0 {
+		conf.Queue = 0
+	}
+	return &workerPool{
+		overflow: conf.Overflow,
+		slots:    make(chan struct{}, conf.Workers+conf.Queue),
+		workers:  make(chan struct{}, conf.Workers),
+	}
+}
+
+//占用队列位置,队列满时按策略阻塞或返回false
+func (p *workerPool) acquire() bool {
+	if p == nil {
+		return true
+	}
+	if p.overflow == OverflowBlock {
+		p.slots <- struct{}{}
+		return true
+	}
+	select {
+	case p.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *workerPool) release() {
+	if p != nil {
+		<-p.slots
+	}
+}
+
+//等待空闲后执行
+func (p *workerPool) run(fn func()) {
+	if p == nil {
+		fn()
+		return
+	}
+	p.workers <- struct{}{}
+	defer func() {
+		<-p.workers
+	}()
+	fn()
+}
+
+//同时处理的消息数,不限制时为0
+func (p *workerPool) limit() int {
+	if p == nil {
+		return 0
+	}
+	return cap(p.workers)
+}
+
+//各池中最小的限制,均不限制时为0
+func minLimit(pools ...*workerPool) int {
+	n := 0
+	for _, p := range pools {
+		if l := p.limit(); l > 0 && (n == 0 || l < n) {
+			n = l
+		}
+	}
+	return n
+}
+
+//在所有池的限制内异步执行fn,任一池已满且不阻塞时不执行,返回该池的策略与false
+func submit(fn func(), pools ...*workerPool) (OverflowPolicy, bool) {
+	for i, p := range pools {
+		if !p.acquire() {
+			for _, q := range pools[:i] {
+				q.release()
+			}
+			return p.overflow, false
+		}
+	}
+	go func() {
+		defer func() {
+			for _, p := range pools {
+				p.release()
+			}
+		}()
+		runIn(pools, fn)
+	}()
+	return OverflowBlock, true
+}
+
+func runIn(pools []*workerPool, fn func()) {
+	if len(pools) == 0 {
+		fn()
+		return
+	}
+	pools[0].run(func() {
+		runIn(pools[1:], fn)
+	})
+}
+
+//并发执行fn(0)到fn(n-1),limit大于0时同时执行的不超过limit个,全部结束后返回
+func runLimited(n, limit int, fn func(i int)) {
+	if limit <= 0 || limit > n {
+		limit = n
+	}
+	sem := make(chan struct{}, limit)
+	wg := sync.WaitGroup{}
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			fn(i)
+		}(i)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,222 @@
+package ws_rpc
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+)
+
+const jsonSchemaDraft = "https://json-schema.org/draft/2020-12/schema"
+
+//JSON Schema (draft 2020-12),只包含导出方法类型用到的关键字
+type Schema struct {
+	Schema               string             `json:"$schema,omitempty"`
+	Ref                  string             `json:"$ref,omitempty"`
+	Title                string             `json:"title,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Type                 interface{}        `json:"type,omitempty"` //类型名,可为空时为[类型名,"null"]
+	Format               string             `json:"format,omitempty"`
+	ContentEncoding      string             `json:"contentEncoding,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	MinItems             *int               `json:"minItems,omitempty"`
+	MaxItems             *int               `json:"maxItems,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+	AnyOf                []*Schema          `json:"anyOf,omitempty"`
+	Defs                 map[string]*Schema `json:"$defs,omitempty"`
+}
+
+//导出所有服务方法的JSON Schema,不含服务描述服务
+//$defs中 waiter.method.request 为参数,waiter.method.response 为返回值,流式方法没有response
+//具名结构体按Go类型名放在$defs中引用,未设置omitempty的字段为必填
+func (s *WsServerConf) JSONSchema() *Schema {
+	return s.waiter.schema()
+}
+
+//导出客户端注册的所有服务方法的JSON Schema,格式同WsServerConf.JSONSchema
+func (w *WSRpcClient) JSONSchema() *Schema {
+	return w.waiter.schema()
+}
+
+//导出服务方法的JSON Schema,name为服务名,格式同WsServerConf.JSONSchema
+func (w *Waiter) JSONSchema(name string) *Schema {
+	b := newSchemaBuilder()
+	b.waiter(stringToLower(name), w)
+	return b.root
+}
+
+func (t *waiterTable) schema() *Schema {
+	t.lock.RLock()
+	names := make([]string, 0, len(t.waiters))
+	waiters := make(map[string]*Waiter, len(t.waiters))
+	for name, w := range t.waiters {
+		if name == ReflectionWaiter {
+			continue
+		}
+		names = append(names, name)
+		waiters[name] = w
+	}
+	t.lock.RUnlock()
+	sort.Strings(names)
+	b := newSchemaBuilder()
+	for _, name := range names {
+		b.waiter(name, waiters[name])
+	}
+	return b.root
+}
+
+type schemaBuilder struct {
+	root  *Schema
+	names map[reflect.Type]string //已生成定义的结构体-->定义名
+	used  map[string]bool
+}
+
+func newSchemaBuilder() *schemaBuilder {
+	return &schemaBuilder{
+		root: &Schema{
+			Schema: jsonSchemaDraft,
+			Defs:   make(map[string]*Schema),
+		},
+		names: make(map[reflect.Type]string),
+		used:  make(map[string]bool),
+	}
+}
+
+func (b *schemaBuilder) waiter(name string, w *Waiter) {
+	w.lock.RLock()
+	calls := make([]string, 0, len(w.methods))
+	for call := range w.methods {
+		calls = append(calls, call)
+	}
+	sort.Strings(calls)
+	methods := make([]*waiterMethod, len(calls))
+	for i, call := range calls {
+		methods[i] = w.methods[call]
+	}
+	w.lock.RUnlock()
+	for i, m := range methods {
+		b.method(name+"."+calls[i], m)
+	}
+}
+
+//无参数或只返回error时对应null
+func (b *schemaBuilder) method(name string, m *waiterMethod) {
+	req := &Schema{Type: "null"}
+	if m.in != nil {
+		req = b.schema(m.in)
+	}
+	req.Title = name + " request"
+	b.root.Defs[name+".request"] = req
+	if m.stream {
+		req.Description = "stream method, items are sent with Stream.Send"
+		return
+	}
+	resp := &Schema{Type: "null"}
+	if m.out != nil {
+		resp = b.schema(m.out)
+	}
+	resp.Title = name + " response"
+	b.root.Defs[name+".response"] = resp
+}
+
+//生成类型的Schema,返回值可由调用方修改
+func (b *schemaBuilder) schema(t reflect.Type) *Schema {
+	if t.Kind() == reflect.Ptr {
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		return nullable(b.schema(t))
+	}
+	switch {
+	case t == timeType:
+		return &Schema{Type: "string", Format: "date-time"}
+	case t.Implements(jsonMarshalerType) || reflect.PtrTo(t).Implements(jsonMarshalerType):
+		//自定义编码,不限制
+		return &Schema{}
+	case t.Kind() != reflect.String && (t.Implements(textMarshalerType) || reflect.PtrTo(t).Implements(textMarshalerType)):
+		return &Schema{Type: "string"}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return &Schema{Type: "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		min := 0.0
+		return &Schema{Type: "integer", Minimum: &min}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &Schema{Type: []string{"string", "null"}, ContentEncoding: "base64"}
+		}
+		return &Schema{Type: []string{"array", "null"}, Items: b.schema(t.Elem())}
+	case reflect.Array:
+		n := t.Len()
+		return &Schema{Type: "array", Items: b.schema(t.Elem()), MinItems: &n, MaxItems: &n}
+	case reflect.Map:
+		return &Schema{Type: []string{"object", "null"}, AdditionalProperties: b.schema(t.Elem())}
+	case reflect.Struct:
+		if typeName(t) == "" {
+			return b.object(t)
+		}
+		return &Schema{Ref: "#/$defs/" + b.define(t)}
+	}
+	return &Schema{}
+}
+
+//具名结构体放入$defs,递归类型通过引用自身描述
+func (b *schemaBuilder) define(t reflect.Type) string {
+	if name, ok := b.names[t]; ok {
+		return name
+	}
+	base := defName.ReplaceAllString(typeName(t), "_")
+	name := base
+	for i := 2; b.used[name]; i++ {
+		//不同包的同名类型
+		name = fmt.Sprintf("%s_%d", base, i)
+	}
+	b.names[t] = name
+	b.used[name] = true
+	b.root.Defs[name] = b.object(t)
+	return name
+}
+
+//定义名只保留json指针与URI中无需转义的字符
+var defName = regexp.MustCompile(`[^A-Za-z0-9_.\-]`)
+
+func (b *schemaBuilder) object(t reflect.Type) *Schema {
+	s := &Schema{Type: "object", Properties: make(map[string]*Schema)}
+	for _, f := range jsonFields(t) {
+		p := b.schema(f.typ)
+		if f.quoted {
+			p = &Schema{Type: "string"}
+		}
+		s.Properties[f.name] = p
+		if !f.omitEmpty {
+			s.Required = append(s.Required, f.name)
+		}
+	}
+	return s
+}
+
+//允许为null
+func nullable(s *Schema) *Schema {
+	switch typ := s.Type.(type) {
+	case string:
+		s.Type = []string{typ, "null"}
+	case []string:
+	default:
+		if s.Ref == "" && len(s.AnyOf) == 0 {
+			//不限制类型
+			return s
+		}
+		return &Schema{AnyOf: []*Schema{s, {Type: "null"}}}
+	}
+	return s
+}
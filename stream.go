@@ -0,0 +1,439 @@
+package ws_rpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"sync"
+)
+
+//流量窗口,发送方最多有这么多帧未被对端读取,超出时Send阻塞等待对端授予额度
+const streamWindow = 64
+
+//流帧,Reply为true表示由执行方发出
+type streamData struct {
+	Type   string      `json:"t"` //stream:数据 stream_end:结束发送 stream_credit:授予发送额度
+	Random string      `json:"i"`
+	Data   interface{} `json:"c,omitempty"`
+	Err    *RPCError   `json:"d,omitempty"`
+	Reply  bool        `json:"r,omitempty"`
+	Credit int         `json:"n,omitempty"`
+}
+
+func createStreamData(codec Codec, rand string, reply bool, data interface{}) ([]byte, error) {
+	d := streamData{
+		Type:   "stream",
+		Random: rand,
+		Data:   data,
+		Reply:  reply,
+	}
+	return codec.Marshal(&d)
+}
+
+func createStreamEndData(codec Codec, rand string, reply bool, err error) ([]byte, error) {
+	d := streamData{
+		Type:   "stream_end",
+		Random: rand,
+		Err:    toRPCError(err),
+		Reply:  reply,
+	}
+	return codec.Marshal(&d)
+}
+
+func createStreamCreditData(codec Codec, rand string, reply bool, credit int) ([]byte, error) {
+	d := streamData{
+		Type:   "stream_credit",
+		Random: rand,
+		Reply:  reply,
+		Credit: credit,
+	}
+	return codec.Marshal(&d)
+}
+
+func isStreamWsFunc(codec Codec, msg []byte) (*streamData, bool) {
+	res := new(streamData)
+	err := codec.Unmarshal(msg, res)
+	if err != nil {
+		return nil, false
+	}
+	switch res.Type {
+	case "stream", "stream_end", "stream_credit":
+	default:
+		return nil, false
+	}
+	if res.Random == "" {
+		return nil, false
+	}
+	if res.Err != nil && res.Err.Code == 0 && res.Err.Message == "" {
+		res.Err = nil
+	}
+	return res, true
+}
+
+//流式调用,与普通调用共用同一连接,双方均可Send与Recv
+//执行方的方法形式为 func([ctx context.Context], [c *Client], [in T], stream *Stream) error,方法返回即结束
+//调用方通过CloseSend结束发送(半关闭),执行方随后Recv返回io.EOF;执行方结束后调用方Recv返回io.EOF或方法返回的错误
+//每端最多缓存streamWindow帧,对端读取后才授予新的发送额度,发送过快时Send阻塞
+type Stream struct {
+	id      string
+	ctx     context.Context
+	reply   bool //本端为执行方
+	codec   Codec
+	write   func(data []byte) error
+	recv    chan *streamData
+	done    chan struct{}
+	once    sync.Once
+	err     error
+	onClose func()
+
+	lock       sync.Mutex
+	credit     int           //剩余发送额度
+	creditChan chan struct{} //收到额度时通知
+	unacked    int           //已读取未授予对端的帧数
+	sendClosed bool          //本端已结束发送
+	recvErr    error         //对端已结束发送
+	ended      bool          //已收到执行方的结束帧
+}
+
+func newStream(ctx context.Context, id string, reply bool, codec Codec, write func(data []byte) error) *Stream {
+	return &Stream{
+		id:         id,
+		ctx:        ctx,
+		reply:      reply,
+		codec:      codec,
+		write:      write,
+		recv:       make(chan *streamData, streamWindow+1),
+		done:       make(chan struct{}),
+		credit:     streamWindow,
+		creditChan: make(chan struct{}, 1),
+	}
+}
+
+//流的ctx,执行方在调用方取消或连接断开时结束
+func (s *Stream) Context() context.Context {
+	return s.ctx
+}
+
+//发送一项,没有发送额度时阻塞到对端读取
+func (s *Stream) Send(v interface{}) error {
+	for {
+		s.lock.Lock()
+		if s.sendClosed {
+			s.lock.Unlock()
+			return NewError(CodeInvalidRequest, "stream send closed")
+		}
+		if s.credit > 0 {
+			s.credit--
+			s.lock.Unlock()
+			break
+		}
+		s.lock.Unlock()
+		select {
+		case <-s.creditChan:
+		case <-s.done:
+			return s.err
+		case <-s.ctx.Done():
+			return ctxError(s.ctx)
+		}
+	}
+	select {
+	case <-s.done:
+		return s.err
+	default:
+	}
+	m, err := createStreamData(s.codec, s.id, s.reply, v)
+	if err != nil {
+		return err
+	}
+	return s.write(m)
+}
+
+//结束本端发送,对端Recv随后返回io.EOF,本端仍可继续Recv
+func (s *Stream) CloseSend() error {
+	return s.closeSend(nil)
+}
+
+func (s *Stream) closeSend(err error) error {
+	s.lock.Lock()
+	if s.sendClosed {
+		s.lock.Unlock()
+		return nil
+	}
+	s.sendClosed = true
+	s.lock.Unlock()
+	m, e := createStreamEndData(s.codec, s.id, s.reply, err)
+	if e != nil {
+		return e
+	}
+	return s.write(m)
+}
+
+//读取下一项,对端结束发送时返回io.EOF或执行方返回的错误
+func (s *Stream) Recv() (interface{}, error) {
+	s.lock.Lock()
+	recvErr := s.recvErr
+	s.lock.Unlock()
+	if recvErr != nil {
+		return nil, recvErr
+	}
+	select {
+	case d := <-s.recv:
+		if d.Type == "stream_end" {
+			var err error = io.EOF
+			if d.Err != nil {
+				err = d.Err
+			}
+			s.lock.Lock()
+			s.recvErr = err
+			s.ended = !s.reply
+			s.lock.Unlock()
+			if !s.reply {
+				//执行方已结束,整个流结束
+				s.finish(err)
+			}
+			return nil, err
+		}
+		s.consumed()
+		return d.Data, nil
+	case <-s.done:
+		return nil, s.err
+	case <-s.ctx.Done():
+		return nil, ctxError(s.ctx)
+	}
+}
+
+//读取下一项并解码到v,v需为非nil指针
+func (s *Stream) RecvTo(v interface{}) error {
+	data, err := s.Recv()
+	if err != nil {
+		return err
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errors.New("decode target must be a non-nil pointer")
+	}
+	val, err := decodeValue(data, rv.Elem().Type())
+	if err != nil {
+		return err
+	}
+	rv.Elem().Set(val)
+	return nil
+}
+
+//调用方提前结束流,通知执行方停止
+func (s *Stream) Close() {
+	s.finish(NewError(CodeCanceled, "stream closed"))
+}
+
+//结束流,err为之后Send与Recv返回的错误
+func (s *Stream) finish(err error) {
+	s.once.Do(func() {
+		s.err = err
+		close(s.done)
+		if s.onClose != nil {
+			s.onClose()
+		}
+	})
+}
+
+//读取协程投递收到的帧,按接收顺序处理,不阻塞读取
+//发送方受额度限制,缓冲已满时对端违反协议,重置流
+func (s *Stream) deliver(d *streamData) {
+	select {
+	case s.recv <- d:
+	case <-s.done:
+	default:
+		s.reset(NewError(CodeInvalidRequest, "stream window exceeded"))
+	}
+}
+
+//以协议错误结束流,执行方回复结束帧,调用方通过Close的取消帧通知执行方停止
+func (s *Stream) reset(err error) {
+	if s.reply {
+		s.closeSend(err)
+	}
+	s.finish(err)
+}
+
+//读取一帧后累计,达到半个窗口时授予对端额度
+func (s *Stream) consumed() {
+	s.lock.Lock()
+	s.unacked++
+	n := 0
+	if s.unacked >= streamWindow/2 {
+		n = s.unacked
+		s.unacked = 0
+	}
+	s.lock.Unlock()
+	if n > 0 {
+		if m, err := createStreamCreditData(s.codec, s.id, s.reply, n); err == nil {
+			s.write(m)
+		}
+	}
+}
+
+//收到对端授予的额度
+func (s *Stream) addCredit(n int) {
+	s.lock.Lock()
+	s.credit += n
+	s.lock.Unlock()
+	select {
+	case s.creditChan <- struct{}{}:
+	default:
+	}
+}
+
+//执行方结束流,未结束发送时发送结束帧
+func (s *Stream) end(err error) {
+	s.closeSend(err)
+	s.finish(io.EOF)
+}
+
+//投递流帧,Reply为true的帧属于本端发起的流,否则属于对端发起的流
+func dispatchStream(streams, serving *streamTable, d *streamData) {
+	table := serving
+	if d.Reply {
+		table = streams
+	}
+	s, ok := table.get(d.Random)
+	if !ok {
+		return
+	}
+	if d.Type == "stream_credit" {
+		s.addCredit(d.Credit)
+		return
+	}
+	s.deliver(d)
+}
+
+//流表
+type streamTable struct {
+	streams sync.Map //id-->*Stream
+}
+
+func (t *streamTable) add(s *Stream) {
+	t.streams.Store(s.id, s)
+}
+
+func (t *streamTable) get(id string) (*Stream, bool) {
+	if s, ok := t.streams.Load(id); ok {
+		return s.(*Stream), true
+	}
+	return nil, false
+}
+
+func (t *streamTable) remove(id string) {
+	t.streams.Delete(id)
+}
+
+//连接断开,结束所有流
+func (t *streamTable) closeAll() {
+	t.streams.Range(func(k, v interface{}) bool {
+		v.(*Stream).finish(errClosed())
+		return true
+	})
+}
+
+//创建调用方的流,ctx结束或Close时通知执行方停止
+func openStream(ctx context.Context, table *streamTable, codec Codec, write func(data []byte) error) *Stream {
+	s := newStream(ctx, nextId(), false, codec, write)
+	s.onClose = func() {
+		table.remove(s.id)
+		s.lock.Lock()
+		ended := s.ended
+		s.lock.Unlock()
+		if !ended {
+			if m, err := createCancelData(codec, s.id); err == nil {
+				write(m)
+			}
+		}
+	}
+	table.add(s)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.finish(ctxError(ctx))
+		case <-s.done:
+		}
+	}()
+	return s
+}
+
+//流式调用服务端方法,ctx结束时流随之结束
+func (w *WSRpcClient) CallStream(ctx context.Context, waiter, method string, in interface{}) (*Stream, error) {
+	s := openStream(ctx, &w.streams, w.codec, w.send)
+	res, err := createStreamCallData(w.codec, waiter, method, s.id, in)
+	if err != nil {
+		s.finish(err)
+		return nil, err
+	}
+	if err = w.send(res); err != nil {
+		err = sendError(err)
+		s.finish(err)
+		return nil, err
+	}
+	return s, nil
+}
+
+//流式调用客户端方法,ctx结束时流随之结束
+func CallClientStream(ctx context.Context, client *Client, waiter, method string, in interface{}) (*Stream, error) {
+	if client == nil {
+		return nil, errClosed()
+	}
+	if client.jsonrpc {
+		return nil, NewError(CodeInvalidRequest, "stream is not supported in jsonrpc mode")
+	}
+	write := func(data []byte) error {
+		return sendData(client, data)
+	}
+	s := openStream(ctx, &client.streams, client.codec, write)
+	res, err := createStreamCallData(client.codec, waiter, method, s.id, in)
+	if err != nil {
+		s.finish(err)
+		return nil, err
+	}
+	if err = sendData(client, res); err != nil {
+		s.finish(err)
+		return nil, err
+	}
+	return s, nil
+}
+
+//接收服务端发来的流式调用,在读取协程中登记,保证之后的流帧能找到对应的流
+func (w *WSRpcClient) acceptStream(res *callData) (*Stream, func()) {
+	ctx, done := w.running.add(res.Random)
+	s := newStream(ctx, res.Random, true, w.codec, w.send)
+	s.onClose = func() {
+		w.serving.remove(s.id)
+	}
+	w.serving.add(s)
+	return s, done
+}
+
+//执行服务端发来的流式调用
+func (w *WSRpcClient) runStream(res *callData, s *Stream, done func()) {
+	defer done()
+	_, err := w.invoke(s.ctx, res, s)
+	s.end(err)
+}
+
+//接收客户端发来的流式调用,在读取协程中登记,保证之后的流帧能找到对应的流
+func (ws *wsMethod) acceptStream(client *Client, res *callData) (*Stream, func()) {
+	ctx, done := client.running.add(res.Random)
+	s := newStream(ctx, res.Random, true, client.codec, func(data []byte) error {
+		return sendData(client, data)
+	})
+	s.onClose = func() {
+		client.serving.remove(s.id)
+	}
+	client.serving.add(s)
+	return s, done
+}
+
+//执行客户端发来的流式调用
+func (ws *wsMethod) runStream(client *Client, res *callData, s *Stream, done func()) {
+	defer done()
+	_, err := ws.invoke(s.ctx, client, res, s)
+	s.end(err)
+}
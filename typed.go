@@ -0,0 +1,55 @@
+package ws_rpc
+
+import (
+	"context"
+	"reflect"
+	"time"
+)
+
+//调用服务端方法,请求与返回使用具体类型,超时时间为TimeOut秒
+func Call[Req, Resp any](client *WSRpcClient, waiter, method string, req Req) (Resp, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(TimeOut)*time.Second)
+	defer cancel()
+	return CallContext[Req, Resp](ctx, client, waiter, method, req)
+}
+
+//调用服务端方法,按ctx的截止时间与取消结束等待
+func CallContext[Req, Resp any](ctx context.Context, client *WSRpcClient, waiter, method string, req Req) (Resp, error) {
+	out, err := client.callValue(ctx, waiter, method, req)
+	if err != nil {
+		var resp Resp
+		return resp, err
+	}
+	return decodeResult[Resp](out)
+}
+
+//调用客户端方法,请求与返回使用具体类型,超时时间为TimeOut秒
+func CallClient[Req, Resp any](client *Client, waiter, method string, req Req) (Resp, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(TimeOut)*time.Second)
+	defer cancel()
+	return CallClientContext[Req, Resp](ctx, client, waiter, method, req)
+}
+
+//调用客户端方法,按ctx的截止时间与取消结束等待
+func CallClientContext[Req, Resp any](ctx context.Context, client *Client, waiter, method string, req Req) (Resp, error) {
+	out, err := callClientValue(ctx, client, waiter, method, req)
+	if err != nil {
+		var resp Resp
+		return resp, err
+	}
+	return decodeResult[Resp](out)
+}
+
+//将调用结果解码为Resp
+func decodeResult[Resp any](src interface{}) (Resp, error) {
+	var resp Resp
+	v, err := decodeValue(src, reflect.TypeOf(&resp).Elem())
+	if err != nil {
+		return resp, err
+	}
+	//结果为null时v无效,Resp为接口时不能断言
+	if v.IsValid() {
+		reflect.ValueOf(&resp).Elem().Set(v)
+	}
+	return resp, nil
+}
@@ -0,0 +1,521 @@
+package ws_rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	clientType  = reflect.TypeOf((*Client)(nil))
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+	streamType  = reflect.TypeOf((*Stream)(nil))
+)
+
+type Waiter struct {
+	//Deprecated: 调用名-->方法,仅为兼容保留,运行中注册与移除时同步更新,请使用RunMethodContext调用方法
+	MethodMap map[string]reflect.Value
+	lock      sync.RWMutex
+	methods   map[string]*waiterMethod
+}
+
+//服务方法
+//支持的形式: func([ctx context.Context], [c *Client], [in T]) ([R], error)
+//流式方法: func([ctx context.Context], [c *Client], [in T], stream *Stream) error
+//in可为任意结构体,切片或基础类型,调用时将参数解码为声明的类型
+type waiterMethod struct {
+	name   string //Go方法名
+	fn     reflect.Value
+	ctx    bool         //首个参数为context.Context
+	client bool         //接收*Client参数,仅服务端可调用
+	in     reflect.Type //参数类型,nil表示无参数
+	out    reflect.Type //返回值类型,nil表示只返回error
+	stream bool         //流式方法
+}
+
+//方法形式错误,列出所有不可用的方法
+type MethodError struct {
+	Waiter  string
+	Methods map[string]error //方法名-->原因
+}
+
+func (e *MethodError) Error() string {
+	names := make([]string, 0, len(e.Methods))
+	for name := range e.Methods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	b := strings.Builder{}
+	b.WriteString("waiter")
+	if e.Waiter != "" {
+		b.WriteString(" " + e.Waiter)
+	}
+	b.WriteString(": unusable methods:")
+	for i, name := range names {
+		if i > 0 {
+			b.WriteString(";")
+		}
+		b.WriteString(" " + name + ": " + e.Methods[name].Error())
+	}
+	return b.String()
+}
+
+//解析并校验方法形式
+func newWaiterMethod(fn reflect.Value) (*waiterMethod, error) {
+	m := &waiterMethod{fn: fn}
+	t := fn.Type()
+	numIn := t.NumIn()
+	if numIn > 0 && t.In(numIn-1) == streamType {
+		m.stream = true
+		numIn--
+	}
+	i := 0
+	if i < numIn && t.In(i) == contextType {
+		m.ctx = true
+		i++
+	}
+	if i < numIn && t.In(i) == clientType {
+		m.client = true
+		i++
+	}
+	if i < numIn {
+		m.in = t.In(i)
+		i++
+		if !encodable(m.in) {
+			return nil, fmt.Errorf("parameter type %s can not be decoded", m.in)
+		}
+	}
+	if i < numIn {
+		return nil, errors.New("too many parameters, want func([context.Context], [*Client], [in], [*Stream]) ([out], error)")
+	}
+	if m.stream && t.NumOut() != 1 {
+		return nil, errors.New("stream method must only return error")
+	}
+	switch t.NumOut() {
+	case 1:
+	case 2:
+		m.out = t.Out(0)
+		if !encodable(m.out) {
+			return nil, fmt.Errorf("result type %s can not be encoded", m.out)
+		}
+	default:
+		return nil, errors.New("bad results, want ([out], error)")
+	}
+	if t.Out(t.NumOut()-1) != errorType {
+		return nil, errors.New("last result must be error")
+	}
+	return m, nil
+}
+
+//类型能否在连接上传输
+func encodable(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Chan, reflect.Func, reflect.UnsafePointer, reflect.Complex64, reflect.Complex128:
+		return false
+	}
+	return true
+}
+
+func (m *waiterMethod) call(ctx context.Context, c *Client, in interface{}, stream *Stream) (interface{}, error) {
+	if m.stream && stream == nil {
+		return nil, NewError(CodeInvalidRequest, "stream method, use CallStream")
+	}
+	if !m.stream && stream != nil {
+		return nil, NewError(CodeInvalidRequest, "not a stream method")
+	}
+	args := make([]reflect.Value, 0, 4)
+	if m.ctx {
+		args = append(args, reflect.ValueOf(ctx))
+	}
+	if m.client {
+		if c == nil {
+			return nil, NewError(CodeInvalidRequest, "method needs *Client, it can only be called on server")
+		}
+		args = append(args, reflect.ValueOf(c))
+	}
+	if m.in != nil {
+		v, err := decodeValue(in, m.in)
+		if err != nil {
+			return nil, Errorf(CodeInvalidParams, "invalid params: %s", err)
+		}
+		args = append(args, v)
+	}
+	if m.stream {
+		args = append(args, reflect.ValueOf(stream))
+	}
+	rel := m.fn.Call(args)
+	var err error
+	if e := rel[len(rel)-1].Interface(); e != nil {
+		err = e.(error)
+	}
+	if m.out == nil {
+		return nil, err
+	}
+	return rel[0].Interface(), err
+}
+
+//运行方法,结果解码为map
+//
+//Deprecated: 结果不是对象时返回错误,请使用RunMethodContext
+func (w *Waiter) RunMethod(name string, c interface{}, in interface{}) (map[string]interface{}, error) {
+	client, _ := c.(*Client)
+	out, err := w.RunMethodContext(context.Background(), name, client, in)
+	if err != nil {
+		return nil, err
+	}
+	return decodeMap(out)
+}
+
+//运行方法,方法首个参数为context.Context时传入ctx,调用方取消时ctx随之结束
+func (w *Waiter) RunMethodContext(ctx context.Context, name string, c *Client, in interface{}) (interface{}, error) {
+	return w.run(ctx, name, c, in, nil)
+}
+
+//运行流式方法,客户端调用时c为nil
+func (w *Waiter) RunStreamContext(ctx context.Context, name string, c *Client, in interface{}, stream *Stream) error {
+	_, err := w.run(ctx, name, c, in, stream)
+	return err
+}
+
+func (w *Waiter) run(ctx context.Context, name string, c *Client, in interface{}, stream *Stream) (interface{}, error) {
+	if method, ok := w.method(name); ok {
+		return method.call(ctx, c, in, stream)
+	}
+	return nil, NewError(CodeNoMethod, "no method")
+}
+
+//按调用名查找方法,未找到时按小写下划线形式查找
+func (w *Waiter) method(name string) (*waiterMethod, bool) {
+	_, method, ok := w.lookup(name)
+	return method, ok
+}
+
+//查找方法,返回注册时的调用名
+func (w *Waiter) lookup(name string) (string, *waiterMethod, bool) {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+	if method, ok := w.methods[name]; ok {
+		return name, method, true
+	}
+	call := stringToLower(name)
+	method, ok := w.methods[call]
+	return call, method, ok
+}
+
+//调用名,Go方法名或其小写下划线形式对应的调用名
+func (w *Waiter) callName(name string) (string, bool) {
+	if call, _, ok := w.lookup(name); ok {
+		return call, true
+	}
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+	for call, m := range w.methods {
+		if m.name == name {
+			return call, true
+		}
+	}
+	return "", false
+}
+
+//运行客户端方法,结果解码为map
+//
+//Deprecated: 结果不是对象时返回错误,请使用RunClientMethodContext
+func (w *Waiter) RunClientMethod(name string, in interface{}) (map[string]interface{}, error) {
+	return w.RunMethod(name, nil, in)
+}
+
+//运行客户端方法,方法首个参数为context.Context时传入ctx
+func (w *Waiter) RunClientMethodContext(ctx context.Context, name string, in interface{}) (interface{}, error) {
+	return w.RunMethodContext(ctx, name, nil, in)
+}
+
+//服务选项
+type WaiterOption func(o *waiterOptions)
+
+type waiterOptions struct {
+	exclude  map[string]bool   //不暴露的方法
+	alias    map[string]string //方法名-->调用名
+	keepName bool              //保留原方法名,不转为小写下划线
+}
+
+//不暴露的方法,按Go方法名
+func Exclude(methods ...string) WaiterOption {
+	return func(o *waiterOptions) {
+		for _, m := range methods {
+			o.exclude[m] = true
+		}
+	}
+}
+
+//指定方法的调用名
+func Alias(method, name string) WaiterOption {
+	return func(o *waiterOptions) {
+		o.alias[method] = name
+	}
+}
+
+//保留Go方法名作为调用名,例:GetUser仍为GetUser
+func KeepMethodName() WaiterOption {
+	return func(o *waiterOptions) {
+		o.keepName = true
+	}
+}
+
+//结构体字段标签,一般写在空白字段上,多个方法以;分隔,调用名为-时不暴露
+//例: _ struct{} `ws_rpc:"Helper:-;GetUser:user"`
+const waiterTag = "ws_rpc"
+
+func (o *waiterOptions) parseTag(t reflect.Type) error {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	for i := 0; i < t.NumField(); i++ {
+		tag, ok := t.Field(i).Tag.Lookup(waiterTag)
+		if !ok {
+			continue
+		}
+		for _, item := range strings.Split(tag, ";") {
+			item = strings.TrimSpace(item)
+			if item == "" {
+				continue
+			}
+			kv := strings.SplitN(item, ":", 2)
+			if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+				return fmt.Errorf("bad %s tag %q, want Method:name or Method:-", waiterTag, item)
+			}
+			method, name := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+			if name == "-" {
+				o.exclude[method] = true
+			} else if _, ok := o.alias[method]; !ok {
+				//选项优先于标签
+				o.alias[method] = name
+			}
+		}
+	}
+	return nil
+}
+
+//方法的调用名
+func (o *waiterOptions) name(method string) string {
+	if name, ok := o.alias[method]; ok {
+		return name
+	}
+	if o.keepName {
+		return method
+	}
+	return stringToLower(method)
+}
+
+//创建服务,obj需为结构体或结构体指针,所有导出方法的形式不可用时返回*MethodError
+func NewWaiter(obj interface{}, opts ...WaiterOption) (*Waiter, error) {
+	if obj == nil {
+		return nil, errors.New("waiter is nil")
+	}
+	w := new(Waiter)
+	objValue := reflect.ValueOf(obj)
+	objType := reflect.TypeOf(obj)
+	w.methods = make(map[string]*waiterMethod)
+	w.MethodMap = make(map[string]reflect.Value)
+	if objType.Kind() != reflect.Struct &&
+		(objType.Kind() != reflect.Ptr || objType.Elem().Kind() != reflect.Struct) {
+		return nil, fmt.Errorf("waiter must be a struct or pointer to struct, got %s", objType)
+	}
+	o := &waiterOptions{
+		exclude: make(map[string]bool),
+		alias:   make(map[string]string),
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if err := o.parseTag(objType); err != nil {
+		return nil, err
+	}
+	bad := make(map[string]error)
+	for method := range o.exclude {
+		if _, ok := objType.MethodByName(method); !ok {
+			bad[method] = errors.New("excluded method does not exist")
+		}
+	}
+	for method := range o.alias {
+		if _, ok := objType.MethodByName(method); !ok {
+			bad[method] = errors.New("aliased method does not exist")
+		}
+	}
+	for i := 0; i < objType.NumMethod(); i += 1 {
+		method := objType.Method(i).Name
+		if o.exclude[method] {
+			continue
+		}
+		m, err := newWaiterMethod(objValue.MethodByName(method))
+		if err != nil {
+			bad[method] = err
+			continue
+		}
+		m.name = method
+		name := o.name(method)
+		if other, ok := w.methods[name]; ok {
+			bad[method] = fmt.Errorf("name %q is already used by %s", name, other.name)
+			continue
+		}
+		w.methods[name] = m
+		w.MethodMap[name] = m.fn
+	}
+	if len(bad) > 0 {
+		return nil, &MethodError{Methods: bad}
+	}
+	if len(w.methods) == 0 {
+		return nil, fmt.Errorf("waiter %s has no exported methods", objType)
+	}
+	return w, nil
+}
+
+//注册函数为方法,name为调用名,不转为小写下划线,clientSide为true时不能接收*Client参数
+func (w *Waiter) addFunc(name string, fn interface{}, clientSide bool) error {
+	if fn == nil || reflect.TypeOf(fn).Kind() != reflect.Func {
+		return fmt.Errorf("%s is not a func", name)
+	}
+	m, err := newWaiterMethod(reflect.ValueOf(fn))
+	if err != nil {
+		return &MethodError{Methods: map[string]error{name: err}}
+	}
+	if clientSide && m.client {
+		return &MethodError{Methods: map[string]error{name: errors.New("*Client parameter is only available on server")}}
+	}
+	m.name = name
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if _, ok := w.methods[name]; ok {
+		return &MethodError{Methods: map[string]error{name: fmt.Errorf("name %q is already used", name)}}
+	}
+	w.methods[name] = m
+	w.MethodMap[name] = m.fn
+	return nil
+}
+
+//移除方法,返回剩余方法数
+func (w *Waiter) remove(name string) (bool, int) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if _, ok := w.methods[name]; !ok {
+		name = stringToLower(name)
+		if _, ok = w.methods[name]; !ok {
+			return false, len(w.methods)
+		}
+	}
+	delete(w.methods, name)
+	delete(w.MethodMap, name)
+	return true, len(w.methods)
+}
+
+//客户端注册的服务不能接收*Client参数
+func (w *Waiter) checkClientSide() error {
+	bad := make(map[string]error)
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+	for _, m := range w.methods {
+		if m.client {
+			bad[m.name] = errors.New("*Client parameter is only available on server")
+		}
+	}
+	if len(bad) > 0 {
+		return &MethodError{Methods: bad}
+	}
+	return nil
+}
+
+//将收到的参数解码为目标类型
+//统一按json规则转换,各编码下数字等类型的表现一致
+func decodeValue(src interface{}, t reflect.Type) (reflect.Value, error) {
+	if src == nil {
+		return reflect.Zero(t), nil
+	}
+	b, err := json.Marshal(src)
+	if err != nil {
+		return reflect.Value{}, err
+	}
+	v := reflect.New(t)
+	if err := json.Unmarshal(b, v.Interface()); err != nil {
+		return reflect.Value{}, err
+	}
+	return v.Elem(), nil
+}
+
+//将调用结果解码为map,兼容原有接口
+func decodeMap(src interface{}) (map[string]interface{}, error) {
+	if src == nil {
+		return nil, nil
+	}
+	v, err := decodeValue(src, reflect.TypeOf(map[string]interface{}{}))
+	if err != nil {
+		return nil, err
+	}
+	return v.Interface().(map[string]interface{}), nil
+}
+
+//服务表,运行中可注册与移除
+type waiterTable struct {
+	lock    sync.RWMutex
+	waiters map[string]*Waiter
+}
+
+func newWaiterTable() *waiterTable {
+	return &waiterTable{waiters: make(map[string]*Waiter)}
+}
+
+func (t *waiterTable) get(name string) (*Waiter, bool) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	w, ok := t.waiters[name]
+	return w, ok
+}
+
+func (t *waiterTable) set(name string, w *Waiter) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.waiters[stringToLower(name)] = w
+}
+
+//注册函数,服务不存在时创建,clientSide为true时不能接收*Client参数
+func (t *waiterTable) addFunc(waiter, method string, fn interface{}, clientSide bool) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	name := stringToLower(waiter)
+	w, ok := t.waiters[name]
+	if !ok {
+		w = &Waiter{methods: make(map[string]*waiterMethod), MethodMap: make(map[string]reflect.Value)}
+	}
+	if err := w.addFunc(method, fn, clientSide); err != nil {
+		if e, ok := err.(*MethodError); ok {
+			e.Waiter = waiter
+		}
+		return err
+	}
+	t.waiters[name] = w
+	return nil
+}
+
+//移除方法,method为空时移除整个服务,服务没有方法时一并移除
+func (t *waiterTable) remove(waiter, method string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	name := stringToLower(waiter)
+	w, ok := t.waiters[name]
+	if !ok {
+		return false
+	}
+	if method == "" {
+		delete(t.waiters, name)
+		return true
+	}
+	removed, left := w.remove(method)
+	if left == 0 {
+		delete(t.waiters, name)
+	}
+	return removed
+}
@@ -8,6 +8,7 @@ import (
 	"log"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,6 +18,16 @@ type WS interface {
 	OnConnect(client *Client)
 }
 
+//需要按接收顺序处理消息时实现,在读取协程中调用,返回true时不再调用OnMessage
+type OrderedWS interface {
+	OnOrderedMessage(client *Client, bytes []byte) bool
+}
+
+//处理队列已满时实现,在读取协程中调用,policy为OverflowReject或OverflowDrop
+type OverflowWS interface {
+	OnOverflow(client *Client, bytes []byte, policy OverflowPolicy)
+}
+
 //客户端 Client
 type Client struct {
 	//用户id
@@ -37,10 +48,31 @@ type Client struct {
 	userPrimary string
 	//通道
 	writeLock sync.Mutex
-	//回调通道
-	callChan chan *resultData
-	callLock sync.Mutex
-	Manager  *ClientManager
+	//等待客户端回复的调用
+	calls pendingTable[*resultData]
+	//等待客户端回复的批量调用
+	batches pendingTable[*batchResultData]
+	//向客户端发起的流
+	streams streamTable
+	//客户端发起,执行中的流
+	serving streamTable
+	//客户端发起,执行中的调用
+	running runTable
+	//文件传输
+	blobs blobTable
+	//rpc编码
+	codec Codec
+	//JSON-RPC 2.0兼容模式
+	jsonrpc bool
+	//握手协商的参数,在读取协程中设置,其他协程读取
+	peer atomic.Pointer[Handshake]
+	//连接配置
+	conf SeverConf
+	//向客户端发起的调用的拦截器
+	interceptors []UnaryInterceptor
+	//连接的消息处理池
+	pool    *workerPool
+	Manager *ClientManager
 }
 
 //定义心跳消息
@@ -51,6 +83,19 @@ type SeverConf struct {
 	Port   int64
 	Path   string
 	Ticker int64
+	//支持的子协议,客户端请求其中之一时选用
+	Subprotocols []string
+	//启用permessage-deflate压缩,小于CompressionThreshold字节的消息不压缩
+	Compression          bool
+	CompressionThreshold int
+	//单条消息最大字节数,超出时以1009关闭连接,0为不限制
+	MaxMessageSize int64
+	//读写超时,0为不限制,读超时需大于客户端心跳间隔
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	//每个连接与整个服务的消息并发处理限制,Workers为0时不限制
+	Workers       WorkerConf
+	ServerWorkers WorkerConf
 }
 
 type MiddlewareFunc func(c Context) error
@@ -82,6 +127,7 @@ func (ws *wsWeb) Start() error {
 		ws.cfg.Path = "/"
 	}
 	ws.Manager = NewManager(ws.cfg.Ticker)
+	ws.Manager.SetWorkers(ws.cfg.ServerWorkers)
 	ws.serve.HandleFunc(ws.cfg.Path, func(w http.ResponseWriter, r *http.Request) {
 		context := NewContext(w, r)
 		for _, m := range ws.method {
@@ -90,7 +136,7 @@ func (ws *wsWeb) Start() error {
 				return
 			}
 		}
-		err := WSStart(context, ws.Manager, ws.client)
+		err := wsStart(context, ws.Manager, ws.client, ws.cfg)
 		if err != nil {
 			log.Println("update websocket err:", err)
 		}
@@ -314,6 +360,14 @@ func (c *Client) RemoveGroup(gid int64) {
 	}
 }
 
+//协商的子协议,未协商时为空
+func (c *Client) Subprotocol() string {
+	if c == nil || c.socket == nil {
+		return ""
+	}
+	return c.socket.Subprotocol()
+}
+
 //获取id
 func (c *Client) GetId() string {
 	return c.id
@@ -416,11 +470,21 @@ var upgrade = websocket.Upgrader{
 
 //解析WS连接
 func WSStart(c Context, manager *ClientManager, w WS) error {
+	return wsStart(c, manager, w, SeverConf{})
+}
+
+func wsStart(c Context, manager *ClientManager, w WS, conf SeverConf) error {
+	upgrader := upgrade
+	upgrader.Subprotocols = conf.Subprotocols
+	upgrader.EnableCompression = conf.Compression
 	//解析ws连接
-	conn, err := upgrade.Upgrade(c.Response(), c.Request(), nil)
+	conn, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
 	if err != nil {
 		return err
 	}
+	if conf.MaxMessageSize > 0 {
+		conn.SetReadLimit(conf.MaxMessageSize)
+	}
 	uid, _ := uuid.NewV4()
 	//初始化一个客户端对象
 	client := &Client{
@@ -430,8 +494,8 @@ func WSStart(c Context, manager *ClientManager, w WS) error {
 		Context:   c,
 		method:    w,
 		writeLock: sync.Mutex{},
-		callChan:  make(chan *resultData),
-		callLock:  sync.Mutex{},
+		conf:      conf,
+		pool:      newWorkerPool(conf.Workers),
 		Manager:   manager,
 	}
 	//把这个对象发送给 管道
@@ -449,7 +513,9 @@ func (c *Client) onConnect() {
 //收到信息时处理
 func (c *Client) onMessage(msg []byte) {
 	defer func() {
-		recover()
+		if err := recover(); err != nil {
+			log.Println(err)
+		}
 	}()
 	if isHeartbeat(msg) {
 		c.SendMsg(msg)
@@ -469,7 +535,12 @@ func isHeartbeat(msg []byte) bool {
 //断开连接
 func (c *Client) onClose() {
 	c.method.OnClose(c)
-	close(c.callChan)
+	c.calls.closeAll()
+	c.batches.closeAll()
+	c.streams.closeAll()
+	c.serving.closeAll()
+	c.blobs.closeAll()
+	c.running.cancelAll()
 }
 
 //关闭连接
@@ -489,7 +560,10 @@ func (c *Client) read() {
 	}()
 	c.onConnect() //调用创建时处理方法
 	for {
-		//读取消息
+		if c.conf.ReadTimeout > 0 {
+			c.socket.SetReadDeadline(time.Now().Add(c.conf.ReadTimeout))
+		}
+		//读取消息,超出大小上限时返回错误并以1009关闭
 		_, message, err := c.socket.ReadMessage()
 		//如果有错误信息，就注销这个连接然后关闭
 		if err != nil {
@@ -499,19 +573,59 @@ func (c *Client) read() {
 		}
 		//收到信息发送到处理方法
 		c.beat = true
-		go c.onMessage(message)
+		if ordered, ok := c.method.(OrderedWS); ok && ordered.OnOrderedMessage(c, message) {
+			continue
+		}
+		if isHeartbeat(message) {
+			c.SendMsg(message)
+			continue
+		}
+		//在连接与服务的并发限制内处理,队列满时按策略阻塞读取,拒绝或丢弃
+		if policy, ok := c.submit(func() { c.onMessage(message) }); !ok {
+			if overflow, ok := c.method.(OverflowWS); ok {
+				overflow.OnOverflow(c, message, policy)
+			}
+		}
 	}
 }
 
+//在连接与服务的消息处理池中执行
+func (c *Client) submit(fn func()) (OverflowPolicy, bool) {
+	return submit(fn, c.pool, c.Manager.pool)
+}
+
+//连接与服务处理池中较小的Workers,批量调用各项的并发上限,不限制时为0
+func (c *Client) limit() int {
+	return minLimit(c.pool, c.Manager.pool)
+}
+
+//发送二进制消息
+func (c *Client) SendBinary(msg []byte) {
+	if c == nil {
+		return
+	}
+	c.writeType(websocket.BinaryMessage, msg)
+}
+
 //写入管道后激活这个进程
 func (c *Client) write(message []byte) {
+	c.writeType(websocket.TextMessage, message)
+}
+
+func (c *Client) writeType(messageType int, message []byte) {
 	c.writeLock.Lock()
 	defer func() {
 		c.writeLock.Unlock()
 		recover()
 	}()
+	if c.conf.Compression {
+		c.socket.EnableWriteCompression(len(message) >= c.conf.CompressionThreshold)
+	}
+	if c.conf.WriteTimeout > 0 {
+		c.socket.SetWriteDeadline(time.Now().Add(c.conf.WriteTimeout))
+	}
 	//有消息就写入，发送给web端
-	err := c.socket.WriteMessage(websocket.TextMessage, message)
+	err := c.socket.WriteMessage(messageType, message)
 	//写不成功数据就关闭
 	if err != nil {
 		c.Manager.unregister <- c
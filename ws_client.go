@@ -1,26 +1,51 @@
 package ws_rpc
 
 import (
+	"context"
 	"errors"
 	"golang.org/x/crypto/bcrypt"
 	"log"
-	"sync"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
 type DisconnectFunc func(w *WSRpcClient)
 
+//服务端发起的调用,在读取协程中登记,排队中即可被取消
+type serverCall struct {
+	res  *callData
+	ctx  context.Context
+	done func()
+}
+
 type WSRpcClient struct {
 	client    WSClient
 	conf      ClientConf
-	waiter    map[string]*Waiter
-	back      chan *resultData
-	call      chan *callData
+	waiter    *waiterTable
+	calls     pendingTable[*resultData]
+	batches   pendingTable[*batchResultData]
+	streams   streamTable
+	serving   streamTable
+	running   runTable
+	blobs     blobTable
+	call      chan *serverCall
 	callClose chan bool
-	lock      sync.Mutex
 	disMethod []DisconnectFunc
+	panicFunc PanicFunc
 	err       chan error
 	isClose   bool
+	codec     Codec
+	welcome   chan *helloData
+	peer      atomic.Pointer[Handshake]
+	//等待服务端回复握手的时间,为0时不握手
+	handshakeWait time.Duration
+	blob      *BlobReceiver
+	//向服务端发起的调用的拦截器
+	interceptors []UnaryInterceptor
+	//服务端发起的调用的并发处理限制
+	workers WorkerConf
+	pool    *workerPool
 }
 
 func NewWsRpcClient(host string, secret string) *WSRpcClient {
@@ -35,34 +60,135 @@ func NewWsRpcClient(host string, secret string) *WSRpcClient {
 		conf.Path = conf.Path + "?token=" + string(hashed)
 	}
 	rpcClient.conf = conf
-	rpcClient.waiter = make(map[string]*Waiter)
+	rpcClient.waiter = newWaiterTable()
 	rpcClient.isClose = false
+	rpcClient.codec = DefaultCodec
+	rpcClient.handshakeWait = time.Duration(TimeOut) * time.Second
 	return rpcClient
 }
 
-func (w *WSRpcClient) RegisterWaiter(waiter string, method interface{}) *WSRpcClient {
-	m := NewWaiter(method)
-	w.waiter[stringToLower(waiter)] = m
+//设置编码,需与服务端支持的编码一致
+func (w *WSRpcClient) SetCodec(codec Codec) *WSRpcClient {
+	w.codec = codec
+	return w
+}
+
+//启用permessage-deflate压缩,小于threshold字节的消息不压缩
+func (w *WSRpcClient) SetCompression(enable bool, threshold int) *WSRpcClient {
+	w.conf.Compression = enable
+	w.conf.CompressionThreshold = threshold
+	return w
+}
+
+//单条消息最大字节数,超出时以1009关闭连接,0为不限制
+func (w *WSRpcClient) SetMaxMessageSize(size int64) *WSRpcClient {
+	w.conf.MaxMessageSize = size
+	return w
+}
+
+//服务端发起的调用的并发处理限制,Workers为0时不限制,需在Start前设置
+func (w *WSRpcClient) SetWorkers(conf WorkerConf) *WSRpcClient {
+	w.workers = conf
+	return w
+}
+
+//等待服务端回复握手的时间,默认TimeOut秒,超时时按旧协议通信,为0时不握手,需在Start前设置
+func (w *WSRpcClient) SetHandshakeTimeout(wait time.Duration) *WSRpcClient {
+	w.handshakeWait = wait
+	return w
+}
+
+//读写超时,0为不限制,读超时需大于心跳间隔
+func (w *WSRpcClient) SetTimeout(read, write time.Duration) *WSRpcClient {
+	w.conf.ReadTimeout = read
+	w.conf.WriteTimeout = write
 	return w
 }
 
+//注册服务,可通过选项排除方法或指定调用名,方法形式不可用时返回错误且不注册
+func (w *WSRpcClient) RegisterWaiter(waiter string, method interface{}, opts ...WaiterOption) error {
+	m, err := NewWaiter(method, opts...)
+	if err == nil {
+		err = m.checkClientSide()
+	}
+	if err != nil {
+		if e, ok := err.(*MethodError); ok {
+			e.Waiter = waiter
+		}
+		return err
+	}
+	w.waiter.set(waiter, m)
+	return nil
+}
+
+//注册函数或闭包为方法,method为调用名,函数不能接收*Client参数,服务不存在时创建
+func (w *WSRpcClient) RegisterFunc(waiter, method string, fn interface{}) error {
+	return w.waiter.addFunc(waiter, method, fn, true)
+}
+
+//移除方法,method为空时移除整个服务,不存在时返回false
+func (w *WSRpcClient) Unregister(waiter, method string) bool {
+	return w.waiter.remove(waiter, method)
+}
+
 func (w *WSRpcClient) DisconnectFunc(method ...DisconnectFunc) *WSRpcClient {
 	w.disMethod = append(w.disMethod, method...)
 	return w
 }
 
+//方法panic时调用,默认打印日志,调用方收到CodeInternal错误
+func (w *WSRpcClient) PanicFunc(method PanicFunc) *WSRpcClient {
+	w.panicFunc = method
+	return w
+}
+
 func (w *WSRpcClient) Start() (*WSRpcClient, error) {
-	w.back = make(chan *resultData)
-	w.call = make(chan *callData)
+	w.call = make(chan *serverCall)
 	w.callClose = make(chan bool, 1)
 	w.err = make(chan error, 1)
-	w.lock = sync.Mutex{}
+	w.welcome = make(chan *helloData, 1)
+	w.pool = newWorkerPool(w.workers)
 	w.isClose = false
-	client, err := NewClient(w.conf, func(msg []byte) {
-		if res, ok := isResWsFunc(msg); ok {
-			w.back <- res
-		} else if res, ok := isCallWsFunc(msg); ok {
-			w.call <- res
+	conf := w.conf
+	if strings.Contains(conf.Path, "?") {
+		conf.Path += "&codec=" + w.codec.Name()
+	} else {
+		conf.Path += "?codec=" + w.codec.Name()
+	}
+	client, err := NewClient(conf, func(msg []byte) {
+		if w.blobs.dispatch(w.codec, msg, nil, w.blob, w.send) {
+			//文件传输帧在读取协程中按顺序处理
+		} else if res, ok := isHelloWsFunc(msg, "welcome"); ok {
+			if res.Err == nil || res.Err.Code == 0 && res.Err.Message == "" {
+				//在读取协程中记录,之后的通知与流式调用帧按协商的功能解析
+				w.peer.Store(&res.Handshake)
+			}
+			select {
+			case w.welcome <- res:
+			default:
+			}
+		} else if res, ok := isResWsFunc(w.codec, msg); ok {
+			w.calls.done(res.Random, res)
+		} else if res, ok := isCallWsFunc(w.codec, msg, w.Handshake()); ok {
+			if res.stream {
+				s, done := w.acceptStream(res)
+				if _, ok := submit(func() { w.runStream(res, s, done) }, w.pool); !ok {
+					//队列已满,流以CodeBusy错误结束
+					s.end(errBusy())
+					done()
+				}
+				return
+			}
+			w.call <- w.acceptCall(res)
+		} else if res, ok := isCancelWsFunc(w.codec, msg); ok {
+			w.running.cancel(res.Random)
+		} else if res, ok := isBatchWsFunc(w.codec, msg); ok {
+			w.submitBatch(res)
+		} else if res, ok := isBatchResultWsFunc(w.codec, msg); ok {
+			w.batches.done(res.Random, res)
+		} else if res, ok := isStreamWsFunc(w.codec, msg); ok {
+			//读取协程中投递,保持流帧顺序
+			dispatchStream(&w.streams, &w.serving, res)
 		}
 	}, func(ws *WSClient, err error) {
 		if w.client.isClose() == false {
@@ -73,36 +199,36 @@ func (w *WSRpcClient) Start() (*WSRpcClient, error) {
 		}
 	})
 	if err != nil {
-		close(w.back)
+		//连接失败时没有可关闭的连接,之后调用Close不再处理
 		close(w.call)
 		close(w.callClose)
-		w.client.Close()
+		w.isClose = true
 		return nil, err
 	}
 	w.client = client
 	go w.backFunc()
+	//握手失败时断开,不触发DisconnectFunc
+	if err = w.handshake(); err != nil {
+		w.Close()
+		return nil, err
+	}
 	return w, nil
 }
 
 func (w *WSRpcClient) backFunc() {
 	for {
 		select {
-		case res := <-w.call:
-			//远程调用客户端Func
-			var err error
-			out := make(map[string]interface{})
-			if waiter, ok := w.waiter[res.Waiter]; ok {
-				out, err = waiter.RunClientMethod(res.Method, res.In)
-			} else {
-				err = errors.New("no waiter")
-			}
-			m, err := createResultData(res, out, err)
-			if err != nil {
+		case call := <-w.call:
+			//每个调用独立执行,执行中仍可接收取消帧,队列满时按策略阻塞读取,拒绝或丢弃
+			policy, ok := submit(func() { w.runCall(call) }, w.pool)
+			if ok {
 				break
 			}
-			err = w.client.SendMessage(m)
-			if err != nil {
-				log.Println(err)
+			call.done()
+			if policy == OverflowReject && !call.res.notify {
+				if m, err := createResultData(w.codec, call.res, nil, errBusy(), w.Handshake() == nil); err == nil {
+					w.send(m)
+				}
 			}
 		case <-w.callClose:
 			close(w.callClose)
@@ -112,6 +238,55 @@ func (w *WSRpcClient) backFunc() {
 	}
 }
 
+//登记服务端发起的调用,通知不可取消
+func (w *WSRpcClient) acceptCall(res *callData) *serverCall {
+	if res.notify {
+		return &serverCall{res: res, ctx: context.Background(), done: func() {}}
+	}
+	ctx, done := w.running.add(res.Random)
+	return &serverCall{res: res, ctx: ctx, done: done}
+}
+
+//远程调用客户端Func
+func (w *WSRpcClient) runCall(call *serverCall) {
+	defer call.done()
+	res := call.res
+	out, err := w.invoke(call.ctx, res, nil)
+	if res.notify {
+		//通知,执行后不回复
+		return
+	}
+	m, err := createResultData(w.codec, res, out, err, w.Handshake() == nil)
+	if err != nil {
+		return
+	}
+	err = w.send(m)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+//执行服务端发起的调用,stream不为nil时为流式调用
+func (w *WSRpcClient) invoke(ctx context.Context, res *callData, stream *Stream) (interface{}, error) {
+	return safeCall(w.panicFunc, res, func() (interface{}, error) {
+		if waiter, ok := w.waiter.get(res.Waiter); ok {
+			return waiter.run(ctx, res.Method, nil, res.In, stream)
+		}
+		return nil, NewError(CodeNoWaiter, "no waiter")
+	})
+}
+
+//按编码发送rpc帧,超出服务端消息大小上限时不发送
+func (w *WSRpcClient) send(data []byte) error {
+	if peer := w.Handshake(); peer != nil && peer.MaxMessageSize > 0 && int64(len(data)) > peer.MaxMessageSize {
+		return Errorf(CodeInvalidRequest, "message size %d exceeds server limit %d", len(data), peer.MaxMessageSize)
+	}
+	if w.codec.Binary() {
+		return w.client.SendBinary(data)
+	}
+	return w.client.SendMessage(data)
+}
+
 func (w *WSRpcClient) Close() {
 	defer func() {
 		if err := recover(); err != nil {
@@ -120,7 +295,12 @@ func (w *WSRpcClient) Close() {
 	}()
 	if w.isClose == false {
 		w.client.Close()
-		close(w.back)
+		w.calls.closeAll()
+		w.batches.closeAll()
+		w.streams.closeAll()
+		w.serving.closeAll()
+		w.blobs.closeAll()
+		w.running.cancelAll()
 		w.callClose <- true
 	}
 	w.isClose = true
@@ -129,7 +309,12 @@ func (w *WSRpcClient) Close() {
 
 func (w *WSRpcClient) disconnect() {
 	w.client.Close()
-	close(w.back)
+	w.calls.closeAll()
+	w.batches.closeAll()
+	w.streams.closeAll()
+	w.serving.closeAll()
+	w.blobs.closeAll()
+	w.running.cancelAll()
 	w.callClose <- true
 	w.err <- errors.New("disconnect")
 }
@@ -140,36 +325,57 @@ func (w *WSRpcClient) Wait() error {
 	return errStr
 }
 
+//调用服务端方法,超时时间为TimeOut秒
 func (w *WSRpcClient) CallFunc(waiter, method string, in map[string]interface{}) (map[string]interface{}, error) {
-	w.lock.Lock()
-	defer w.lock.Unlock()
-	rand := getRandString(4)
-	res, err := createCallData(waiter, method, rand, in)
-	if err != nil {
-		return nil, err
-	}
-	err = w.client.SendMessage(res)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(TimeOut)*time.Second)
+	defer cancel()
+	return w.CallFuncContext(ctx, waiter, method, in)
+}
+
+//调用服务端方法,按ctx的截止时间与取消结束等待
+func (w *WSRpcClient) CallFuncContext(ctx context.Context, waiter, method string, in map[string]interface{}) (map[string]interface{}, error) {
+	out, err := w.callValue(ctx, waiter, method, in)
 	if err != nil {
 		return nil, err
 	}
-	t := time.NewTicker(time.Duration(TimeOut) * time.Second)
-	defer t.Stop()
-	for {
-		select {
-		case callback := <-w.back:
-			if callback.Random == rand &&
-				callback.Waiter == waiter &&
-				callback.Method == stringToLower(method) {
-				var err error
-				if callback.Err != "" {
-					err = errors.New(callback.Err)
-				} else {
-					err = nil
-				}
-				return callback.Out, err
-			}
-		case <-t.C:
-			return nil, errors.New("call func timeout")
+	return decodeMap(out)
+}
+
+//通知服务端方法,不等待回复
+func (w *WSRpcClient) Notify(waiter, method string, in interface{}) error {
+	info := newCallInfo(nil, waiter, method, in, true)
+	_, err := intercept(context.Background(), w.interceptors, info, func(ctx context.Context, info *CallInfo) (interface{}, error) {
+		res, err := createNotifyData(w.codec, info.Waiter, info.Method, info.In)
+		if err != nil {
+			return nil, err
 		}
-	}
+		if err = w.send(res); err != nil {
+			return nil, sendError(err)
+		}
+		return nil, nil
+	})
+	return err
+}
+
+func (w *WSRpcClient) callValue(ctx context.Context, waiter, method string, in interface{}) (interface{}, error) {
+	info := newCallInfo(nil, waiter, method, in, false)
+	return intercept(ctx, w.interceptors, info, func(ctx context.Context, info *CallInfo) (interface{}, error) {
+		//每个调用独立登记,回复按id匹配,调用之间互不阻塞
+		id, back := w.calls.add()
+		defer w.calls.remove(id)
+		res, err := createCallData(w.codec, info.Waiter, info.Method, id, info.In)
+		if err != nil {
+			return nil, err
+		}
+		err = w.send(res)
+		if err != nil {
+			return nil, sendError(err)
+		}
+		return waitResult(ctx, back, func() {
+			//通知服务端停止执行
+			if m, err := createCancelData(w.codec, id); err == nil {
+				w.send(m)
+			}
+		})
+	})
 }
@@ -1,144 +1,295 @@
 package ws_rpc
 
 import (
+	"context"
 	"encoding/json"
-	"errors"
-	"fmt"
+	"log"
 	"math/rand"
-	"reflect"
+	"runtime/debug"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const TimeOut = 2
 const Ticker = 60
 
+//rpc服务默认的单条消息最大字节数
+const DefaultMaxMessageSize = 16 << 20
+
 type callData struct {
-	Waiter string                 `json:"a"`
-	Method string                 `json:"b"`
-	In     map[string]interface{} `json:"c"`
-	Random string                 `json:"d"`
+	Waiter string      `json:"a"`
+	Method string      `json:"b"`
+	In     interface{} `json:"c"`
+	Random string      `json:"d"`
+	Reply  string      `json:"e,omitempty"` //回复帧的id,调用帧不带此字段
+	notify bool        //通知,不需要回复
+	stream bool        //流式调用
 }
 
 type resultData struct {
-	Waiter string                 `json:"a"`
-	Method string                 `json:"b"`
-	Out    map[string]interface{} `json:"c"`
-	Err    string                 `json:"d"`
-	Random string                 `json:"e"`
+	Waiter string      `json:"a"`
+	Method string      `json:"b"`
+	Out    interface{} `json:"c"`
+	Err    *RPCError   `json:"d,omitempty"`
+	Random string      `json:"e"`
+}
+
+//未握手的旧版本对端,错误为字符串
+type legacyResultData struct {
+	Waiter string      `json:"a"`
+	Method string      `json:"b"`
+	Out    interface{} `json:"c"`
+	Err    string      `json:"d"`
+	Random string      `json:"e"`
+}
+
+//取消调用,由调用方发往执行方
+type cancelData struct {
+	Type   string `json:"t"`
+	Random string `json:"i"`
 }
 
-func createCallData(waiter, method, rand string, data map[string]interface{}) ([]byte, error) {
+func createCallData(codec Codec, waiter, method, rand string, data interface{}) ([]byte, error) {
 	d := callData{
 		Waiter: stringToLower(waiter),
-		Method: stringToLower(method),
+		Method: method,
 		In:     data,
 		Random: "c" + rand,
 	}
-	return encoder(&d)
+	return codec.Marshal(&d)
+}
+
+//通知帧不带id,执行方不回复
+func createNotifyData(codec Codec, waiter, method string, data interface{}) ([]byte, error) {
+	d := callData{
+		Waiter: stringToLower(waiter),
+		Method: method,
+		In:     data,
+		Random: "n",
+	}
+	return codec.Marshal(&d)
+}
+
+//流式调用帧,结果以流帧返回
+func createStreamCallData(codec Codec, waiter, method, rand string, data interface{}) ([]byte, error) {
+	d := callData{
+		Waiter: stringToLower(waiter),
+		Method: method,
+		In:     data,
+		Random: "s" + rand,
+	}
+	return codec.Marshal(&d)
 }
 
-func createResultData(call *callData, data map[string]interface{}, err error) ([]byte, error) {
-	errs := fmt.Sprint(err)
-	if errs == "<nil>" {
-		errs = ""
+//legacy为true时对端未握手,错误按旧格式只发送消息字符串
+func createResultData(codec Codec, call *callData, data interface{}, err error, legacy bool) ([]byte, error) {
+	if legacy {
+		d := legacyResultData{
+			Waiter: call.Waiter,
+			Method: call.Method,
+			Out:    data,
+			Random: "r" + call.Random,
+		}
+		if e := toRPCError(err); e != nil {
+			d.Err = e.Message
+		}
+		return codec.Marshal(&d)
 	}
 	d := resultData{
 		Waiter: call.Waiter,
 		Method: call.Method,
 		Out:    data,
-		Err:    errs,
+		Err:    toRPCError(err),
 		Random: "r" + call.Random,
 	}
-	return encoder(&d)
+	return codec.Marshal(&d)
+}
+
+func createCancelData(codec Codec, rand string) ([]byte, error) {
+	d := cancelData{
+		Type:   "cancel",
+		Random: rand,
+	}
+	return codec.Marshal(&d)
 }
 
-func isResWsFunc(msg []byte) (*resultData, bool) {
+func isResWsFunc(codec Codec, msg []byte) (*resultData, bool) {
 	res := new(resultData)
-	err := decoder(msg, res)
+	err := codec.Unmarshal(msg, res)
 	if err != nil {
 		return nil, false
 	}
 	if res.Method == "" || res.Random == "" || res.Random[:1] != "r" {
 		return nil, false
 	}
+	if res.Err != nil && res.Err.Code == 0 && res.Err.Message == "" {
+		res.Err = nil
+	}
 	res.Random = res.Random[1:]
 	return res, true
 }
 
-func isCallWsFunc(msg []byte) (*callData, bool) {
+//通知与流式调用需握手时协商,旧版本对端的回复以错误字符串占用id字段,不能当作调用
+func isCallWsFunc(codec Codec, msg []byte, peer *Handshake) (*callData, bool) {
 	res := new(callData)
-	err := decoder(msg, res)
+	err := codec.Unmarshal(msg, res)
 	if err != nil {
 		return nil, false
 	}
-	if res.Method == "" || res.Random == "" || res.Random[:1] != "c" {
+	if res.Method == "" || res.Random == "" || res.Reply != "" {
+		return nil, false
+	}
+	switch res.Random[:1] {
+	case "c":
+	case "n":
+		if !peer.HasFeature("notify") {
+			return nil, false
+		}
+	case "s":
+		if !peer.HasFeature("stream") {
+			return nil, false
+		}
+	default:
 		return nil, false
 	}
+	res.notify = res.Random[:1] == "n"
+	res.stream = res.Random[:1] == "s"
 	res.Random = res.Random[1:]
 	return res, true
 }
 
-type Waiter struct {
-	MethodMap map[string]reflect.Value
+func isCancelWsFunc(codec Codec, msg []byte) (*cancelData, bool) {
+	res := new(cancelData)
+	err := codec.Unmarshal(msg, res)
+	if err != nil {
+		return nil, false
+	}
+	if res.Type != "cancel" || res.Random == "" {
+		return nil, false
+	}
+	return res, true
+}
+
+//方法panic时调用,stack为panic时的调用栈
+type PanicFunc func(waiter, method string, err interface{}, stack []byte)
+
+//未设置PanicFunc时打印日志
+func logPanic(waiter, method string, err interface{}, stack []byte) {
+	log.Printf("ws_rpc: panic in %s.%s: %v\n%s", waiter, method, err, stack)
 }
 
-//运行方法
-func (w *Waiter) RunMethod(name string, c interface{}, in interface{}) (map[string]interface{}, error) {
-	if method, ok := w.MethodMap[stringToLower(name)]; ok {
-		rel := method.Call([]reflect.Value{reflect.ValueOf(c), reflect.ValueOf(in)})
-		if len(rel) != 2 {
-			return nil, errors.New("类型错误,方式输出类型需为(map[string]interface{}, error)")
-		}
-		if _, ok := rel[0].Interface().(map[string]interface{}); !ok {
-			return nil, errors.New("类型错误,方式输出类型需为(map[string]interface{}, error)")
-		}
-		var err error
-		if rel[1].Interface() == nil {
-			err = nil
-		} else {
-			err = rel[1].Interface().(error)
+//执行调用,方法panic时转为内部错误返回给调用方
+func safeCall(onPanic PanicFunc, call *callData, run func() (interface{}, error)) (out interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if onPanic == nil {
+				onPanic = logPanic
+			}
+			onPanic(call.Waiter, call.Method, r, debug.Stack())
+			out = nil
+			err = NewError(CodeInternal, "internal error")
 		}
-		return rel[0].Interface().(map[string]interface{}), err
+	}()
+	return run()
+}
+
+var callSeq uint64
+
+//调用id,进程内唯一,同一连接上各类调用不会重复
+func nextId() string {
+	return strconv.FormatUint(atomic.AddUint64(&callSeq, 1), 36)
+}
+
+//等待回复的调用表,按调用id投递回复
+type pendingTable[T any] struct {
+	calls sync.Map //id-->chan T
+}
+
+//登记调用,返回唯一id与回复通道
+func (t *pendingTable[T]) add() (string, chan T) {
+	id := nextId()
+	ch := make(chan T, 1)
+	t.calls.Store(id, ch)
+	return id, ch
+}
+
+//投递回复,没有对应调用时返回false
+func (t *pendingTable[T]) done(id string, res T) bool {
+	if ch, ok := t.calls.LoadAndDelete(id); ok {
+		ch.(chan T) <- res
+		return true
 	}
-	return nil, errors.New("no method")
+	return false
 }
 
-//运行客户端方法
-func (w *Waiter) RunClientMethod(name string, in interface{}) (map[string]interface{}, error) {
-	if method, ok := w.MethodMap[stringToLower(name)]; ok {
-		rel := method.Call([]reflect.Value{reflect.ValueOf(in)})
-		if len(rel) != 2 {
-			return nil, errors.New("类型错误,方式输出类型需为(map[string]interface{}, error)")
+func (t *pendingTable[T]) remove(id string) {
+	t.calls.Delete(id)
+}
+
+//连接断开,结束所有等待中的调用
+func (t *pendingTable[T]) closeAll() {
+	t.calls.Range(func(k, v interface{}) bool {
+		if ch, ok := t.calls.LoadAndDelete(k); ok {
+			close(ch.(chan T))
 		}
-		if _, ok := rel[0].Interface().(map[string]interface{}); !ok {
-			return nil, errors.New("类型错误,方式输出类型需为(map[string]interface{}, error)")
+		return true
+	})
+}
+
+//执行中的调用表,收到取消帧时结束对应调用的ctx
+type runTable struct {
+	calls sync.Map //id-->context.CancelFunc
+}
+
+//登记调用,返回调用的ctx与结束函数
+func (t *runTable) add(id string) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.calls.Store(id, cancel)
+	return ctx, func() {
+		t.calls.Delete(id)
+		cancel()
+	}
+}
+
+func (t *runTable) cancel(id string) {
+	if cancel, ok := t.calls.LoadAndDelete(id); ok {
+		cancel.(context.CancelFunc)()
+	}
+}
+
+//连接断开,取消所有执行中的调用
+func (t *runTable) cancelAll() {
+	t.calls.Range(func(k, v interface{}) bool {
+		t.cancel(k.(string))
+		return true
+	})
+}
+
+//等待调用回复,ctx结束时执行onCancel通知对端,并返回超时或取消错误
+func waitResult(ctx context.Context, back chan *resultData, onCancel func()) (interface{}, error) {
+	select {
+	case callback, ok := <-back:
+		if !ok {
+			return nil, errClosed()
 		}
-		var err error
-		if rel[1].Interface() == nil {
-			err = nil
-		} else {
-			err = rel[1].Interface().(error)
+		if callback.Err != nil {
+			return callback.Out, callback.Err
 		}
-		return rel[0].Interface().(map[string]interface{}), err
+		return callback.Out, nil
+	case <-ctx.Done():
+		onCancel()
+		return nil, ctxError(ctx)
 	}
-	return nil, errors.New("no method")
 }
 
-//创建服务
-func NewWaiter(obj interface{}) *Waiter {
-	w := new(Waiter)
-	objValue := reflect.ValueOf(obj)
-	objType := reflect.TypeOf(obj)
-	w.MethodMap = make(map[string]reflect.Value)
-	if objType.Elem().Kind() != reflect.Struct {
-		return nil
-	}
-	for i := 0; i < objType.NumMethod(); i += 1 {
-		name := objType.Method(i).Name
-		w.MethodMap[stringToLower(name)] = objValue.MethodByName(name)
+//ctx结束的原因转为rpc错误
+func ctxError(ctx context.Context) *RPCError {
+	if ctx.Err() == context.DeadlineExceeded {
+		return &RPCError{Code: CodeTimeout, Message: "call func timeout", Retryable: true, cause: ctx.Err()}
 	}
-	return w
+	return toRPCError(ctx.Err())
 }
 
 type HashLoop struct {
@@ -1,17 +1,40 @@
 package ws_rpc
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func TestNewWsRpcServer(t *testing.T) {
 	secret := "MyDarkSecret"
 	server := NewWsRpcServer(38888, secret)
-	server.RegisterWaiter("test", &ClientTest{}) //注册服务(可多次注册)
+	err := server.RegisterWaiter("test", &ClientTest{}) //注册服务(可多次注册)
+	if err != nil {
+		log.Println(err)
+		return
+	}
 	//server.OnConnectFunc(callbackFunc)
 	server.OnCloseFunc(callbackFunc)
-	err := server.Start()
+	err = server.Start()
 	log.Println(err)
 }
 
@@ -31,8 +54,13 @@ func (t *ClientTest) Test(c *Client, in map[string]interface{}) (map[string]inte
 /******************************************************************************/
 
 func TestNewWsRpcClient(t *testing.T) {
-	client, err := NewWsRpcClient("127.0.0.1:38888", "MyDarkSecret").
-		RegisterWaiter("test", &Callback{}). //注册服务(可多次注册)
+	rpcClient := NewWsRpcClient("127.0.0.1:38888", "MyDarkSecret")
+	err := rpcClient.RegisterWaiter("test", &Callback{}) //注册服务(可多次注册)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	client, err := rpcClient.
 		DisconnectFunc(Disconnect). //连接中断处理(可多次注册)
 		Start()
 	if err != nil {
@@ -63,3 +91,1788 @@ func (c *Callback) Test(in map[string]interface{}) (map[string]interface{}, erro
 	log.Println("Server Callback: ", in)
 	return nil, nil
 }
+
+func TestCodec(t *testing.T) {
+	for _, codec := range []Codec{JSONCodec, LegacyCodec, MsgpackCodec} {
+		in := map[string]interface{}{"in": "test"}
+		b, err := createCallData(codec, "Test", "TestFunc", "abcd", in)
+		if err != nil {
+			t.Fatal(codec.Name(), err)
+		}
+		call, ok := isCallWsFunc(codec, b, nil)
+		if !ok {
+			t.Fatal(codec.Name(), "decode call data failed")
+		}
+		if call.Waiter != "test" || call.Method != "TestFunc" || call.Random != "abcd" || jsonEncode(call.In) != jsonEncode(in) {
+			t.Fatal(codec.Name(), "call data mismatch:", call)
+		}
+		if _, ok := isResWsFunc(codec, b); ok {
+			t.Fatal(codec.Name(), "call data decoded as result")
+		}
+	}
+}
+
+type typedReq struct {
+	A  int    `json:"a"`
+	B  int    `json:"b"`
+	Op string `json:"op"`
+}
+
+type typedResp struct {
+	Sum int `json:"sum"`
+}
+
+type TypedTest struct{}
+
+func (t *TypedTest) Add(in typedReq) (typedResp, error) {
+	return typedResp{Sum: in.A + in.B}, nil
+}
+
+func (t *TypedTest) Len(in []string) (int, error) {
+	return len(in), nil
+}
+
+func (t *TypedTest) Ping() error {
+	return nil
+}
+
+func TestWaiterTyped(t *testing.T) {
+	w, err := NewWaiter(&TypedTest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := w.RunClientMethodContext(context.Background(), "add", map[string]interface{}{"a": 1.0, "b": 2.0})
+	if err != nil || out.(typedResp).Sum != 3 {
+		t.Fatal(out, err)
+	}
+	out, err = w.RunClientMethodContext(context.Background(), "len", []interface{}{"a", "b"})
+	if err != nil || out.(int) != 2 {
+		t.Fatal(out, err)
+	}
+	if _, err = w.RunClientMethodContext(context.Background(), "ping", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.RunClientMethodContext(context.Background(), "add", "bad"); err == nil {
+		t.Fatal("want invalid params error")
+	}
+}
+
+func TestWaiterCompat(t *testing.T) {
+	w, err := NewWaiter(&RpcTest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := w.MethodMap["echo"]; !ok {
+		t.Fatal("method map missing echo:", w.MethodMap)
+	}
+	out, err := w.RunClientMethod("echo", map[string]interface{}{"a": "b"})
+	if err != nil || out["a"] != "b" {
+		t.Fatal(out, err)
+	}
+	out, err = w.RunMethod("echo", nil, map[string]interface{}{"a": "c"})
+	if err != nil || out["a"] != "c" {
+		t.Fatal(out, err)
+	}
+	//结果不是对象时返回错误
+	if _, err = w.RunClientMethod("delay", map[string]interface{}{"id": 1}); err == nil {
+		t.Fatal("want error for non object result")
+	}
+	if err = w.addFunc("plus", func(in int) (int, error) { return in + 1, nil }, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := w.MethodMap["plus"]; !ok {
+		t.Fatal("method map missing added func")
+	}
+	if ok, _ := w.remove("plus"); !ok {
+		t.Fatal("remove failed")
+	}
+	if _, ok := w.MethodMap["plus"]; ok {
+		t.Fatal("method map keeps removed func")
+	}
+}
+
+type BadTest struct{}
+
+func (t *BadTest) Good(in map[string]interface{}) (map[string]interface{}, error) {
+	return in, nil
+}
+
+func (t *BadTest) TooMany(a, b int) error {
+	return nil
+}
+
+func (t *BadTest) NoError() int {
+	return 0
+}
+
+func TestRegisterWaiter(t *testing.T) {
+	server := NewWsRpcServer(38888, "")
+	err := server.RegisterWaiter("bad", &BadTest{})
+	e, ok := err.(*MethodError)
+	if !ok || len(e.Methods) != 2 || e.Methods["TooMany"] == nil || e.Methods["NoError"] == nil {
+		t.Fatal("want MethodError for TooMany and NoError, got:", err)
+	}
+	if _, ok := server.waiter.get("bad"); ok {
+		t.Fatal("bad waiter registered")
+	}
+	if err = server.RegisterWaiter("test", &ClientTest{}); err != nil {
+		t.Fatal(err)
+	}
+	if err = server.RegisterWaiter("nil", nil); err == nil {
+		t.Fatal("want error for nil waiter")
+	}
+	client := NewWsRpcClient("127.0.0.1:38888", "")
+	if err = client.RegisterWaiter("test", &ClientTest{}); err == nil {
+		t.Fatal("want error for *Client parameter on client side")
+	}
+	if err = client.RegisterWaiter("test", &Callback{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type OptionTest struct {
+	_ struct{} `ws_rpc:"Helper:-;GetUser:user"`
+}
+
+func (t *OptionTest) GetUser(in string) (string, error) {
+	return in, nil
+}
+
+func (t *OptionTest) GetList() ([]string, error) {
+	return nil, nil
+}
+
+func (t *OptionTest) Helper(a, b int) int {
+	return a + b
+}
+
+func (t *OptionTest) Internal() error {
+	return nil
+}
+
+func TestWaiterOption(t *testing.T) {
+	w, err := NewWaiter(&OptionTest{}, Exclude("Internal"), KeepMethodName())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"user", "GetList"} {
+		if _, ok := w.method(name); !ok {
+			t.Fatal("missing method", name)
+		}
+	}
+	for _, name := range []string{"GetUser", "get_list", "Helper", "Internal"} {
+		if _, ok := w.method(name); ok {
+			t.Fatal("unexpected method", name)
+		}
+	}
+	w, err = NewWaiter(&OptionTest{}, Alias("GetUser", "get"), Alias("GetList", "get"), Exclude("Internal"))
+	if _, ok := err.(*MethodError); !ok {
+		t.Fatal("want duplicate name error, got:", err)
+	}
+	if _, err = NewWaiter(&OptionTest{}, Exclude("Missing")); err == nil {
+		t.Fatal("want error for missing excluded method")
+	}
+}
+
+func TestRPCError(t *testing.T) {
+	//旧版本以字符串传输错误
+	old := []byte(`{"a":"test","b":"test","c":null,"d":"no method","e":"r1"}`)
+	res, ok := isResWsFunc(JSONCodec, old)
+	if !ok || res.Err == nil || res.Err.Code != CodeUnknown || res.Err.Message != "no method" {
+		t.Fatal("decode string error failed:", res)
+	}
+	old = []byte(`{"a":"test","b":"test","c":null,"d":"","e":"r1"}`)
+	if res, ok = isResWsFunc(JSONCodec, old); !ok || res.Err != nil {
+		t.Fatal("empty string error should be nil:", res.Err)
+	}
+	for _, codec := range []Codec{JSONCodec, LegacyCodec, MsgpackCodec} {
+		call := &callData{Waiter: "test", Method: "test", Random: "1"}
+		e := NewError(CodeNoWaiter, "no waiter").WithDetails(map[string]interface{}{"waiter": "test"})
+		b, err := createResultData(codec, call, nil, fmt.Errorf("wrap: %w", e), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, ok = isResWsFunc(codec, b)
+		if !ok || res.Err.Code != CodeNoWaiter || res.Err.Details["waiter"] != "test" {
+			t.Fatal(codec.Name(), "result error mismatch:", res.Err)
+		}
+	}
+}
+
+func TestJSONRPCMessage(t *testing.T) {
+	waiter, method, ok := splitJSONRPCMethod("test.get_list")
+	if !ok || waiter != "test" || method != "get_list" {
+		t.Fatal("split method failed:", waiter, method)
+	}
+	if _, _, ok = splitJSONRPCMethod("test."); ok {
+		t.Fatal("want error for empty method")
+	}
+	in, err := decodeJSONRPCParams([]byte(`[{"a":1}]`))
+	if m, ok := in.(map[string]interface{}); err != nil || !ok || m["a"] != float64(1) {
+		t.Fatal("single positional param should be unwrapped:", in, err)
+	}
+	if _, err = decodeJSONRPCParams([]byte(`1`)); err == nil {
+		t.Fatal("want error for scalar params")
+	}
+	b, _ := json.Marshal(createJSONRPCResult(nil, nil, nil))
+	if string(b) != `{"jsonrpc":"2.0","result":null,"id":null}` {
+		t.Fatal("result must be present on success:", string(b))
+	}
+	req, _ := createJSONRPCRequest("Test", "get_list", "1", 5)
+	b, _ = json.Marshal(req)
+	if string(b) != `{"jsonrpc":"2.0","method":"test.get_list","params":[5],"id":"1"}` {
+		t.Fatal("request mismatch:", string(b))
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	b, err := createHelloData("hello", Handshake{Version: ProtocolVersion, Codec: "json", Features: []string{"stream", "unknown"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello, ok := isHelloWsFunc(b, "hello")
+	if !ok || hello.Version != ProtocolVersion || hello.Codec != "json" {
+		t.Fatal("decode hello failed:", string(b))
+	}
+	if _, ok = isHelloWsFunc(b, "welcome"); ok {
+		t.Fatal("hello must not be taken as welcome")
+	}
+	h := Handshake{Features: intersectFeatures(protocolFeatures, hello.Features)}
+	if !h.HasFeature("stream") || h.HasFeature("unknown") {
+		t.Fatal("bad features:", h.Features)
+	}
+	if _, ok = isHelloWsFunc([]byte(`{"a":"test","b":"test","c":null,"d":"c1"}`), "hello"); ok {
+		t.Fatal("call frame taken as hello")
+	}
+}
+
+func TestBlobChunk(t *testing.T) {
+	b := createBlobChunk("file-1", 1<<32, []byte("hello"))
+	c, ok := parseBlobChunk(b)
+	if !ok || c.id != "file-1" || c.offset != 1<<32 || string(c.data) != "hello" {
+		t.Fatal("parse chunk failed:", c)
+	}
+	if _, ok = isBlobWsFunc(JSONCodec, b); ok {
+		t.Fatal("chunk taken as control frame")
+	}
+	//旧编码帧首字节为0时第二字节固定,不会与数据块混淆
+	for _, codec := range []Codec{JSONCodec, LegacyCodec, MsgpackCodec} {
+		m, _ := createCallData(codec, "test", "test", "1", nil)
+		if isBlobChunk(m) {
+			t.Fatal(codec.Name(), "call frame taken as chunk")
+		}
+	}
+	if name := blobFileName("../a/b"); name != "blob____a_b" {
+		t.Fatal("unsafe file name:", name)
+	}
+}
+
+func TestFileBlobStoreOwner(t *testing.T) {
+	store, err := NewFileBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := BlobInfo{Id: "file-1", Size: 10}
+	write := func(c *Client, data string) int64 {
+		f, offset, err := store.Open(c, info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteAt([]byte(data), offset)
+		f.Close()
+		return offset
+	}
+	a := &Client{id: "a"}
+	write(a, "abc")
+	//其他连接的相同id不能续传
+	if offset := write(&Client{id: "b"}, "x"); offset != 0 {
+		t.Fatal("resumed another connection's blob:", offset)
+	}
+	if offset := write(a, "de"); offset != 3 {
+		t.Fatal("same connection should resume:", offset)
+	}
+	//相同用户的不同连接可以续传
+	user := map[string]interface{}{"uid": 1}
+	write(&Client{id: "c", userInfo: user, userPrimary: "uid"}, "abc")
+	if offset := write(&Client{id: "d", userInfo: user, userPrimary: "uid"}, "de"); offset != 3 {
+		t.Fatal("same user should resume:", offset)
+	}
+	if store.Path(a, info.Id) == store.Path(nil, info.Id) {
+		t.Fatal("server and client blobs share a path")
+	}
+}
+
+func TestStreamWindowExceeded(t *testing.T) {
+	sent := make(chan []byte, 4)
+	s := newStream(context.Background(), "1", true, JSONCodec, func(data []byte) error {
+		sent <- data
+		return nil
+	})
+	//对端不等待额度,读取协程投递时不能阻塞
+	finished := make(chan struct{})
+	go func() {
+		for i := 0; i < streamWindow+2; i++ {
+			s.deliver(&streamData{Type: "stream", Data: i})
+		}
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Fatal("deliver blocked")
+	}
+	<-s.done
+	var e *RPCError
+	if !errors.As(s.err, &e) || e.Code != CodeInvalidRequest {
+		t.Fatal("want protocol error, got:", s.err)
+	}
+	d, ok := isStreamWsFunc(JSONCodec, <-sent)
+	if !ok || d.Type != "stream_end" || d.Err == nil || d.Err.Code != CodeInvalidRequest {
+		t.Fatal("want end frame with protocol error, got:", d)
+	}
+}
+
+//打开文件前等待release
+type slowBlobStore struct {
+	BlobStore
+	release chan struct{}
+}
+
+func (s *slowBlobStore) Open(c *Client, info BlobInfo) (BlobFile, int64, error) {
+	<-s.release
+	return s.BlobStore.Open(c, info)
+}
+
+func TestBlobReceiveNonBlocking(t *testing.T) {
+	files, err := NewFileBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &slowBlobStore{BlobStore: files, release: make(chan struct{})}
+	finished := make(chan error, 1)
+	receiver := &BlobReceiver{Store: store, Done: func(c *Client, info BlobInfo, err error) {
+		finished <- err
+	}}
+	sent := make(chan []byte, blobWindow+8)
+	send := func(data []byte) error {
+		sent <- data
+		return nil
+	}
+	table := &blobTable{}
+	start, _ := createBlobData(JSONCodec, &blobData{Type: "blob_start", Random: "f1", Seq: "1", Info: &BlobInfo{Size: 1 << 20}})
+	//打开文件与发送方超出窗口时,读取协程均不阻塞
+	dispatched := make(chan struct{})
+	go func() {
+		table.dispatch(JSONCodec, start, nil, receiver, send)
+		for i := 0; i < blobWindow+3; i++ {
+			table.dispatch(JSONCodec, createBlobChunk("f1", int64(i), []byte("x")), nil, receiver, send)
+		}
+		close(dispatched)
+	}()
+	select {
+	case <-dispatched:
+	case <-time.After(time.Second):
+		t.Fatal("dispatch blocked")
+	}
+	d, ok := isBlobWsFunc(JSONCodec, <-sent)
+	if !ok || d.Err == nil || d.Err.Code != CodeInvalidRequest {
+		t.Fatal("want window error, got:", d)
+	}
+	close(store.release)
+	select {
+	case err := <-finished:
+		var e *RPCError
+		if !errors.As(err, &e) || e.Code != CodeInvalidRequest {
+			t.Fatal("want window error, got:", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("receive did not finish")
+	}
+}
+
+func TestRegisterFunc(t *testing.T) {
+	server := NewWsRpcServer(38888, "")
+	prefix := "hello "
+	err := server.RegisterFunc("greet", "say", func(name string) (string, error) {
+		return prefix + name, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = server.RegisterFunc("greet", "say", func() error { return nil }); err == nil {
+		t.Fatal("want error for duplicate name")
+	}
+	if err = server.RegisterFunc("greet", "bad", 1); err == nil {
+		t.Fatal("want error for non func")
+	}
+	w, _ := server.waiter.get("greet")
+	out, err := w.RunMethodContext(context.Background(), "say", nil, "ws")
+	if err != nil || out != "hello ws" {
+		t.Fatal("call func failed:", out, err)
+	}
+	if !server.Unregister("greet", "say") || server.Unregister("greet", "say") {
+		t.Fatal("unregister failed")
+	}
+	if _, ok := server.waiter.get("greet"); ok {
+		t.Fatal("empty waiter should be removed")
+	}
+	client := NewWsRpcClient("127.0.0.1:38888", "")
+	if err = client.RegisterFunc("cb", "who", func(c *Client) error { return nil }); err == nil {
+		t.Fatal("want error for *Client parameter on client side")
+	}
+}
+
+type DescNode struct {
+	Name     string      `json:"name"`
+	Children []*DescNode `json:"children,omitempty"`
+	Data     []byte      `json:"data"`
+	Skip     int         `json:"-"`
+	DescBase
+}
+
+type DescBase struct {
+	Id int64 `json:"id,string"`
+}
+
+func TestDescribeType(t *testing.T) {
+	info := describeType(reflect.TypeOf(DescNode{}))
+	if info.Kind != "object" || len(info.Fields) != 4 {
+		t.Fatal("bad fields:", info)
+	}
+	children := info.Fields[1]
+	if children.Name != "children" || !children.Optional || children.Type.Kind != "array" ||
+		!children.Type.Elem.Ref || !children.Type.Elem.Nullable {
+		t.Fatal("bad recursive field:", children, children.Type.Elem)
+	}
+	if info.Fields[2].Type.Kind != "bytes" || info.Fields[3].Name != "id" || info.Fields[3].Type.Kind != "string" {
+		t.Fatal("bad fields:", info.Fields[2], info.Fields[3])
+	}
+	if sum := describeType(reflect.TypeOf([4]byte{})); sum.Kind != "array" || sum.Elem.Kind != "uint" || sum.Nullable {
+		t.Fatal("byte array should be an array:", sum)
+	}
+	server := NewWsRpcServer(38888, "")
+	if err := server.RegisterWaiter("typed", &TypedTest{}); err != nil {
+		t.Fatal(err)
+	}
+	list := server.Services()
+	if len(list) != 1 || list[0].Name != "typed" || len(list[0].Methods) != 3 {
+		t.Fatal("bad services:", list)
+	}
+	add := list[0].Methods[0]
+	if add.Name != "add" || add.In.Name != "ws_rpc.typedReq" || len(add.In.Fields) != 3 || add.Out.Fields[0].Type.Kind != "int" {
+		t.Fatal("bad method:", add)
+	}
+	if ping := list[0].Methods[2]; ping.In != nil || ping.Out != nil {
+		t.Fatal("bad method:", ping)
+	}
+}
+
+//JSON Schema测试用服务,在TypedTest的方法外增加递归类型的方法
+type SchemaTest struct {
+	TypedTest
+}
+
+func (t *SchemaTest) Tree(in *DescNode) ([]DescNode, error) {
+	return nil, nil
+}
+
+func TestJSONSchema(t *testing.T) {
+	w, err := NewWaiter(&SchemaTest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := w.JSONSchema("typed")
+	if _, err = json.Marshal(s); err != nil {
+		t.Fatal(err)
+	}
+	add := s.Defs["typed.add.request"]
+	if s.Schema != jsonSchemaDraft || add == nil || add.Ref != "#/$defs/ws_rpc.typedReq" {
+		t.Fatal("bad add request:", add)
+	}
+	req := s.Defs["ws_rpc.typedReq"]
+	if req.Type != "object" || len(req.Required) != 3 || req.Properties["a"].Type != "integer" {
+		t.Fatal("bad typedReq:", req)
+	}
+	if ping := s.Defs["typed.ping.response"]; ping == nil || ping.Type != "null" {
+		t.Fatal("bad ping response:", ping)
+	}
+	tree := s.Defs["typed.tree.request"]
+	if len(tree.AnyOf) != 2 || tree.AnyOf[0].Ref != "#/$defs/ws_rpc.DescNode" {
+		t.Fatal("bad tree request:", tree)
+	}
+	node := s.Defs["ws_rpc.DescNode"]
+	if node.Properties["children"].Items.AnyOf[0].Ref != "#/$defs/ws_rpc.DescNode" ||
+		node.Properties["data"].ContentEncoding != "base64" || node.Properties["id"].Type != "string" ||
+		len(node.Required) != 3 {
+		t.Fatal("bad DescNode:", node)
+	}
+}
+
+func TestIntercept(t *testing.T) {
+	order := make([]string, 0)
+	trace := func(name string) UnaryInterceptor {
+		return func(ctx context.Context, info *CallInfo, next UnaryHandler) (interface{}, error) {
+			order = append(order, name)
+			out, err := next(ctx, info)
+			order = append(order, name)
+			return out, err
+		}
+	}
+	deny := func(ctx context.Context, info *CallInfo, next UnaryHandler) (interface{}, error) {
+		if info.Method == "secret" {
+			return nil, NewError(CodeInvalidRequest, "denied")
+		}
+		info.In = "changed"
+		return next(ctx, info)
+	}
+	list := []UnaryInterceptor{trace("a"), trace("b"), deny}
+	handler := func(ctx context.Context, info *CallInfo) (interface{}, error) {
+		order = append(order, "run")
+		return info.In, nil
+	}
+	out, err := intercept(context.Background(), list, newCallInfo(nil, "test", "echo", "in", false), handler)
+	if err != nil || out != "changed" || strings.Join(order, ",") != "a,b,run,b,a" {
+		t.Fatal("bad chain:", out, err, order)
+	}
+	order = order[:0]
+	if _, err = intercept(context.Background(), list, newCallInfo(nil, "test", "secret", nil, false), handler); err == nil {
+		t.Fatal("want error")
+	}
+	if strings.Join(order, ",") != "a,b,b,a" {
+		t.Fatal("handler should not run:", order)
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	table := newPolicyTable()
+	table.add("admin", "", []Policy{RequireRole("admin")})
+	table.add("admin", "drop_all", []Policy{AllowUids(1)})
+	table.add("user", "", []Policy{RequireContext(func(ctx Context) bool { return ctx.Get("login") == true })})
+	ctx := NewContext(nil, httptest.NewRequest("GET", "/", nil))
+	admin := &Client{Context: ctx}
+	admin.userInfo = map[string]interface{}{"uid": float64(1), "roles": []interface{}{"user", "admin"}}
+	admin.userPrimary = "uid"
+	user := &Client{Context: ctx}
+	user.userInfo = map[string]interface{}{"uid": 2, "role": "admin"}
+	user.userPrimary = "uid"
+	guest := &Client{Context: ctx}
+	if table.check(admin, "admin", "drop_all") != nil || table.check(user, "admin", "list") != nil {
+		t.Fatal("want allowed")
+	}
+	var e *RPCError
+	if err := table.check(user, "admin", "drop_all"); !errors.As(err, &e) || e.Code != CodePermissionDenied {
+		t.Fatal("want permission denied, got:", err)
+	}
+	if table.check(guest, "admin", "list") == nil || table.check(guest, "user", "get") == nil {
+		t.Fatal("want guest denied")
+	}
+	ctx.Set("login", true)
+	if table.check(guest, "user", "get") != nil || table.check(guest, "other", "get") != nil {
+		t.Fatal("want guest allowed")
+	}
+}
+
+type PolicyTest struct{}
+
+func (t *PolicyTest) DropAll() error {
+	return nil
+}
+
+func (t *PolicyTest) GetUser() error {
+	return nil
+}
+
+func (t *PolicyTest) List() error {
+	return nil
+}
+
+func TestSetPolicy(t *testing.T) {
+	server := NewWsRpcServer(38888, "test")
+	if err := server.RegisterWaiter("Admin", &PolicyTest{}, Alias("GetUser", "user")); err != nil {
+		t.Fatal(err)
+	}
+	deny := func(c *Client) bool { return false }
+	//未注册的服务与方法返回错误
+	if server.SetPolicy("missing", "", deny) == nil || server.SetPolicy("admin", "drop", deny) == nil {
+		t.Fatal("want error for unknown names")
+	}
+	//Go方法名与别名背后的方法按调用名保存
+	if err := server.SetPolicy("Admin", "DropAll", deny); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.SetPolicy("admin", "GetUser", deny); err != nil {
+		t.Fatal(err)
+	}
+	ws := &wsMethod{waiter: server.waiter, policies: server.policies}
+	call := func(method string) error {
+		_, err := ws.invoke(context.Background(), &Client{}, &callData{Waiter: "admin", Method: method}, nil)
+		return err
+	}
+	var e *RPCError
+	for _, method := range []string{"drop_all", "DropAll", "user"} {
+		if err := call(method); !errors.As(err, &e) || e.Code != CodePermissionDenied {
+			t.Fatal(method, "want permission denied, got:", err)
+		}
+	}
+	if err := call("list"); err != nil {
+		t.Fatal(err)
+	}
+	//服务描述只包含有权调用的方法
+	reflection, _ := server.waiter.get(ReflectionWaiter)
+	out, err := reflection.run(context.Background(), "list", &Client{}, nil, nil)
+	list := out.([]ServiceInfo)
+	if err != nil || len(list) != 1 || len(list[0].Methods) != 1 || list[0].Methods[0].Name != "list" {
+		t.Fatal("bad visible services:", list, err)
+	}
+	server.SetPolicy("admin", "", deny)
+	if out, err = reflection.run(context.Background(), "list", &Client{}, nil, nil); err != nil || len(out.([]ServiceInfo)) != 0 {
+		t.Fatal("hidden waiter listed:", out, err)
+	}
+	if _, err = reflection.run(context.Background(), "describe", &Client{}, "admin", nil); !errors.As(err, &e) || e.Code != CodeNoWaiter {
+		t.Fatal("hidden waiter described:", err)
+	}
+}
+
+/******************************************************************************/
+
+var testPort int64 = 39000
+
+type RpcTest struct{}
+
+type delayReq struct {
+	Id int `json:"id"`
+	Ms int `json:"ms"`
+}
+
+func (t *RpcTest) Echo(in map[string]interface{}) (map[string]interface{}, error) {
+	return in, nil
+}
+
+func (t *RpcTest) Delay(ctx context.Context, in delayReq) (int, error) {
+	select {
+	case <-time.After(time.Duration(in.Ms) * time.Millisecond):
+		return in.Id, nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+//启动测试服务端,注册rpc服务,返回端口
+func startTestServer(t *testing.T, setup func(s *WsServerConf)) int64 {
+	port := atomic.AddInt64(&testPort, 1)
+	server := NewWsRpcServer(port, "test")
+	if err := server.RegisterWaiter("rpc", &RpcTest{}); err != nil {
+		t.Fatal(err)
+	}
+	if setup != nil {
+		setup(&server)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- server.Start()
+	}()
+	//等待服务端开始监听
+	addr := fmt.Sprint("127.0.0.1:", port)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		select {
+		case err := <-errc:
+			t.Fatal("server stopped:", err)
+		default:
+		}
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return port
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("server not listening:", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+//连接测试服务端,测试结束时断开
+func newTestClient(t *testing.T, port int64, setup func(w *WSRpcClient)) *WSRpcClient {
+	client := NewWsRpcClient(fmt.Sprint("127.0.0.1:", port), "test")
+	if setup != nil {
+		setup(client)
+	}
+	client, err := client.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.Close)
+	return client
+}
+
+func TestStartClosedPort(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	client := NewWsRpcClient(addr, "")
+	if _, err = client.Start(); err == nil {
+		t.Fatal("want dial error")
+	}
+	client.Close()
+}
+
+func TestHandshakeFallback(t *testing.T) {
+	//不支持握手的旧服务端,忽略hello
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(rw, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+	client, err := NewWsRpcClient(host, "").SetHandshakeTimeout(100 * time.Millisecond).Start()
+	if err != nil {
+		t.Fatal("want legacy fallback, got:", err)
+	}
+	if client.Handshake() != nil {
+		t.Fatal("want no handshake:", client.Handshake())
+	}
+	client.Close()
+	var e *RPCError
+	_, err = NewWsRpcClient(host, "").SetCodec(JSONCodec).SetHandshakeTimeout(100 * time.Millisecond).Start()
+	if !errors.As(err, &e) || e.Code != CodeIncompatible {
+		t.Fatal("want incompatible without handshake, got:", err)
+	}
+}
+
+func TestCallDuringHandshake(t *testing.T) {
+	const n = 20
+	done := make(chan error, n)
+	port := startTestServer(t, func(s *WsServerConf) {
+		//连接后立即调用客户端,与客户端握手同时进行
+		s.OnConnectFunc(func(c *Client) {
+			for i := 0; i < n; i++ {
+				go func(i int) {
+					out, err := CallClient[int, int](c, "cb", "double", i)
+					if err == nil && out != i*2 {
+						err = fmt.Errorf("call %d got %d", i, out)
+					}
+					done <- err
+				}(i)
+			}
+		})
+	})
+	newTestClient(t, port, func(w *WSRpcClient) {
+		w.RegisterFunc("cb", "double", func(in int) (int, error) {
+			return in * 2, nil
+		})
+	})
+	for i := 0; i < n; i++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestConcurrentCalls(t *testing.T) {
+	client := newTestClient(t, startTestServer(t, nil), nil)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			//先发起的调用后返回,回复需按id投递到各自的调用
+			out, err := Call[delayReq, int](client, "rpc", "delay", delayReq{Id: i, Ms: (20 - i) * 20})
+			if err != nil || out != i {
+				t.Error("call", i, "got", out, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n := countPending(&client.calls); n != 0 {
+		t.Fatal("pending calls left:", n)
+	}
+}
+
+func TestConcurrentClientCalls(t *testing.T) {
+	connected := make(chan *Client, 1)
+	port := startTestServer(t, func(s *WsServerConf) {
+		s.OnConnectFunc(func(c *Client) { connected <- c })
+	})
+	newTestClient(t, port, func(w *WSRpcClient) {
+		w.RegisterWaiter("rpc", &RpcTest{})
+	})
+	c := <-connected
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			out, err := CallClientFunc(c, "rpc", "echo", map[string]interface{}{"id": i})
+			if err != nil || out["id"] != float64(i) {
+				t.Error("echo", i, "got", out, err)
+			}
+			//先发起的调用后返回,回复需按id投递到各自的调用
+			n, err := CallClient[delayReq, int](c, "rpc", "delay", delayReq{Id: i, Ms: (20 - i) * 20})
+			if err != nil || n != i {
+				t.Error("delay", i, "got", n, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n := countPending(&c.calls); n != 0 {
+		t.Fatal("pending calls left:", n)
+	}
+}
+
+func countPending[T any](p *pendingTable[T]) int {
+	n := 0
+	p.calls.Range(func(k, v interface{}) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+func TestCancelReachesHandler(t *testing.T) {
+	canceled := make(chan error, 2)
+	wait := func(ctx context.Context) error {
+		<-ctx.Done()
+		canceled <- ctx.Err()
+		return ctx.Err()
+	}
+	connected := make(chan *Client, 1)
+	port := startTestServer(t, func(s *WsServerConf) {
+		s.RegisterFunc("cancel", "wait", wait)
+		s.OnConnectFunc(func(c *Client) { connected <- c })
+	})
+	client := newTestClient(t, port, func(w *WSRpcClient) {
+		w.RegisterFunc("cancel", "wait", wait)
+	})
+	//客户端调用超时,服务端方法的ctx随之结束
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	var e *RPCError
+	if _, err := CallContext[interface{}, interface{}](ctx, client, "cancel", "wait", nil); !errors.As(err, &e) || e.Code != CodeTimeout {
+		t.Fatal("want timeout, got:", err)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("server handler was not canceled")
+	}
+	//服务端取消调用,客户端方法的ctx随之结束
+	c := <-connected
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	if _, err := CallClientContext[interface{}, interface{}](ctx, c, "cancel", "wait", nil); !errors.As(err, &e) || e.Code != CodeCanceled {
+		t.Fatal("want canceled, got:", err)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("client handler was not canceled")
+	}
+	//等待客户端发出回复后再断开
+	time.Sleep(50 * time.Millisecond)
+}
+
+type typedSum struct {
+	Sum int `json:"sum"`
+}
+
+func TestWorkerPool(t *testing.T) {
+	if newWorkerPool(WorkerConf{}) != nil {
+		t.Fatal("want nil pool without limit")
+	}
+	conn := newWorkerPool(WorkerConf{Workers: 1, Queue: 1, Overflow: OverflowDrop})
+	server := newWorkerPool(WorkerConf{Workers: 2, Overflow: OverflowReject})
+	release := make(chan struct{})
+	started := make(chan struct{}, 3)
+	task := func() {
+		started <- struct{}{}
+		<-release
+	}
+	for i := 0; i < 2; i++ {
+		if _, ok := submit(task, conn, server); !ok {
+			t.Fatal("want accepted", i)
+		}
+	}
+	if policy, ok := submit(task, conn, server); ok || policy != OverflowDrop {
+		t.Fatal("want dropped by connection pool")
+	}
+	if policy, ok := submit(task, nil, server); ok || policy != OverflowReject {
+		t.Fatal("want rejected by server pool")
+	}
+	<-started
+	select {
+	case <-started:
+		t.Fatal("connection allows one worker")
+	default:
+	}
+	close(release)
+	<-started
+}
+
+func TestWorkerCallback(t *testing.T) {
+	policies := []WorkerConf{
+		{Workers: 1, Overflow: OverflowBlock},
+		{Workers: 1, Queue: 1, Overflow: OverflowReject},
+	}
+	for _, conf := range policies {
+		port := startTestServer(t, func(s *WsServerConf) {
+			s.SetWorkers(conf, WorkerConf{})
+			//方法中回调客户端,回复帧不能排在自身之后
+			s.RegisterFunc("cb", "ask", func(c *Client, in map[string]interface{}) (map[string]interface{}, error) {
+				return CallClientFunc(c, "cb", "echo", in)
+			})
+		})
+		client := newTestClient(t, port, func(w *WSRpcClient) {
+			w.SetWorkers(conf)
+			w.RegisterFunc("cb", "echo", func(in map[string]interface{}) (map[string]interface{}, error) {
+				return in, nil
+			})
+		})
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		out, err := client.CallFuncContext(ctx, "cb", "ask", map[string]interface{}{"a": "b"})
+		cancel()
+		if err != nil || out["a"] != "b" {
+			t.Fatal("callback with", conf, "got", out, err)
+		}
+	}
+}
+
+func TestCancelQueued(t *testing.T) {
+	started := make(chan bool, 1)
+	port := startTestServer(t, func(s *WsServerConf) {
+		s.SetWorkers(WorkerConf{Workers: 1, Queue: 1, Overflow: OverflowReject}, WorkerConf{})
+		s.RegisterFunc("queue", "check", func(ctx context.Context) error {
+			started <- ctx.Err() != nil
+			return nil
+		})
+	})
+	client := newTestClient(t, port, nil)
+	go Call[delayReq, int](client, "rpc", "delay", delayReq{Ms: 300})
+	time.Sleep(50 * time.Millisecond)
+	//排队中的调用超时,取消帧在执行前到达
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	CallContext[interface{}, interface{}](ctx, client, "queue", "check", nil)
+	select {
+	case canceled := <-started:
+		if !canceled {
+			t.Fatal("queued call was not canceled")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("queued call did not run")
+	}
+}
+
+func TestBatchWorkers(t *testing.T) {
+	var running, most int32
+	port := startTestServer(t, func(s *WsServerConf) {
+		s.SetWorkers(WorkerConf{Workers: 2, Overflow: OverflowReject}, WorkerConf{})
+		s.RegisterFunc("slow", "run", func() error {
+			n := atomic.AddInt32(&running, 1)
+			defer atomic.AddInt32(&running, -1)
+			for {
+				m := atomic.LoadInt32(&most)
+				if n <= m || atomic.CompareAndSwapInt32(&most, m, n) {
+					break
+				}
+			}
+			time.Sleep(50 * time.Millisecond)
+			return nil
+		})
+	})
+	client := newTestClient(t, port, nil)
+	calls := make([]BatchCall, 6)
+	for i := range calls {
+		calls[i] = BatchCall{Waiter: "slow", Method: "run"}
+	}
+	results, err := client.CallBatch(calls, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range results {
+		if r.Err != nil {
+			t.Fatal("item", i, r.Err)
+		}
+	}
+	//批量调用各项不超过连接的Workers
+	if n := atomic.LoadInt32(&most); n != 2 {
+		t.Fatal("want 2 concurrent items, got", n)
+	}
+}
+
+func TestPanicRecover(t *testing.T) {
+	panics := make(chan string, 2)
+	hook := func(waiter, method string, err interface{}, stack []byte) {
+		panics <- waiter + "." + method
+	}
+	boom := func() error {
+		panic("boom")
+	}
+	connected := make(chan *Client, 1)
+	port := startTestServer(t, func(s *WsServerConf) {
+		s.OnPanicFunc(hook)
+		s.RegisterFunc("bad", "boom", boom)
+		s.OnConnectFunc(func(c *Client) { connected <- c })
+	})
+	client := newTestClient(t, port, func(w *WSRpcClient) {
+		w.PanicFunc(hook)
+		w.RegisterFunc("bad", "boom", boom)
+		w.RegisterFunc("bad", "echo", func(in int) (int, error) { return in, nil })
+	})
+	c := <-connected
+	var e *RPCError
+	//服务端方法panic,调用方收到CodeInternal错误,连接仍可用
+	if _, err := CallContext[interface{}, interface{}](context.Background(), client, "bad", "boom", nil); !errors.As(err, &e) || e.Code != CodeInternal {
+		t.Fatal("want internal error from server, got:", err)
+	}
+	if name := <-panics; name != "bad.boom" {
+		t.Fatal("server hook got", name)
+	}
+	if out, err := Call[delayReq, int](client, "rpc", "delay", delayReq{Id: 1}); err != nil || out != 1 {
+		t.Fatal("server connection unusable:", out, err)
+	}
+	//客户端方法panic
+	if _, err := CallClient[interface{}, interface{}](c, "bad", "boom", nil); !errors.As(err, &e) || e.Code != CodeInternal {
+		t.Fatal("want internal error from client, got:", err)
+	}
+	if name := <-panics; name != "bad.boom" {
+		t.Fatal("client hook got", name)
+	}
+	if out, err := CallClient[int, int](c, "bad", "echo", 2); err != nil || out != 2 {
+		t.Fatal("client connection unusable:", out, err)
+	}
+}
+
+func TestNotify(t *testing.T) {
+	got := make(chan int, 2)
+	push := func(in int) error {
+		got <- in
+		//通知的错误不回复
+		return errors.New("ignored")
+	}
+	echo := func(in int) (int, error) {
+		return in, nil
+	}
+	send := func(conn *websocket.Conn) func([]byte, error) error {
+		return func(m []byte, err error) error {
+			if err != nil {
+				return err
+			}
+			return conn.WriteMessage(websocket.TextMessage, m)
+		}
+	}
+	//通知之后发送调用,对端收到的下一帧应为该调用的回复
+	check := func(conn *websocket.Conn) error {
+		if err := send(conn)(createNotifyData(LegacyCodec, "event", "push", 7)); err != nil {
+			return err
+		}
+		if err := send(conn)(createCallData(LegacyCodec, "event", "echo", "1", 1)); err != nil {
+			return err
+		}
+		conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		_, m, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		if res, ok := isResWsFunc(LegacyCodec, m); !ok || res.Random != "1" || res.Err != nil {
+			return fmt.Errorf("want reply to call 1, got: %s", m)
+		}
+		select {
+		case v := <-got:
+			if v != 7 {
+				return fmt.Errorf("bad notify value: %d", v)
+			}
+		case <-time.After(time.Second):
+			return errors.New("notify handler did not run")
+		}
+		return nil
+	}
+	welcome := Handshake{Version: ProtocolVersion, Codec: LegacyCodec.Name(), Features: protocolFeatures}
+
+	//服务端执行客户端的通知
+	port := startTestServer(t, func(s *WsServerConf) {
+		s.RegisterFunc("event", "push", push)
+		s.RegisterFunc("event", "echo", echo)
+	})
+	token, _ := bcrypt.GenerateFromPassword([]byte("test"), bcrypt.DefaultCost)
+	conn, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://127.0.0.1:%d/?token=%s", port, token), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err = send(conn)(createHelloData("hello", welcome, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = conn.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+	if err = check(conn); err != nil {
+		t.Fatal("server:", err)
+	}
+
+	//客户端执行服务端的通知
+	result := make(chan error, 1)
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(rw, r, nil)
+		if err != nil {
+			result <- err
+			return
+		}
+		defer conn.Close()
+		if _, _, err = conn.ReadMessage(); err == nil {
+			err = send(conn)(createHelloData("welcome", welcome, nil))
+		}
+		if err == nil {
+			err = check(conn)
+		}
+		result <- err
+	}))
+	defer srv.Close()
+	client := NewWsRpcClient(strings.TrimPrefix(srv.URL, "http://"), "")
+	client.RegisterFunc("event", "push", push)
+	client.RegisterFunc("event", "echo", echo)
+	if _, err = client.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err = <-result; err != nil {
+		t.Fatal("client:", err)
+	}
+}
+
+func TestTypedCall(t *testing.T) {
+	nothing := func() (interface{}, error) { return nil, nil }
+	add := func(in []int) (typedSum, error) {
+		return typedSum{Sum: in[0] + in[1]}, nil
+	}
+	connected := make(chan *Client, 1)
+	port := startTestServer(t, func(s *WsServerConf) {
+		s.RegisterFunc("typed", "nothing", nothing)
+		s.RegisterFunc("typed", "add", add)
+		s.OnConnectFunc(func(c *Client) { connected <- c })
+	})
+	client := newTestClient(t, port, func(w *WSRpcClient) {
+		w.RegisterFunc("typed", "nothing", nothing)
+		w.RegisterFunc("typed", "add", add)
+	})
+	if out, err := Call[[]int, typedSum](client, "typed", "add", []int{1, 2}); err != nil || out.Sum != 3 {
+		t.Fatal(out, err)
+	}
+	//结果为null时接口类型返回nil
+	if out, err := Call[interface{}, interface{}](client, "typed", "nothing", nil); err != nil || out != nil {
+		t.Fatal(out, err)
+	}
+	if out, err := Call[[]int, interface{}](client, "typed", "add", []int{2, 3}); err != nil || out.(map[string]interface{})["sum"] != 5.0 {
+		t.Fatal(out, err)
+	}
+	c := <-connected
+	if out, err := CallClient[[]int, typedSum](c, "typed", "add", []int{1, 2}); err != nil || out.Sum != 3 {
+		t.Fatal(out, err)
+	}
+	if out, err := CallClient[any, any](c, "typed", "nothing", nil); err != nil || out != nil {
+		t.Fatal(out, err)
+	}
+	if out, err := CallClient[[]int, *typedSum](c, "typed", "add", []int{2, 3}); err != nil || out.Sum != 5 {
+		t.Fatal(out, err)
+	}
+}
+
+func TestLegacyPeerResult(t *testing.T) {
+	port := startTestServer(t, nil)
+	token, _ := bcrypt.GenerateFromPassword([]byte("test"), bcrypt.DefaultCost)
+	conn, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://127.0.0.1:%d/?token=%s", port, token), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	//旧版本客户端不发送hello,回复中的错误为字符串
+	type legacyResult struct {
+		Out    map[string]interface{} `json:"c"`
+		Err    string                 `json:"d"`
+		Random string                 `json:"e"`
+	}
+	read := func(waiter, method, random string) legacyResult {
+		call, err := LegacyCodec.Marshal(map[string]interface{}{"a": waiter, "b": method, "c": map[string]interface{}{"x": 1}, "d": random})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := conn.WriteMessage(websocket.TextMessage, call); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		_, m, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var res legacyResult
+		if err := LegacyCodec.Unmarshal(m, &res); err != nil {
+			t.Fatal("legacy client cannot decode reply:", err)
+		}
+		return res
+	}
+	res := read("rpc", "echo", "c1")
+	if res.Err != "" || res.Out["x"] != 1.0 || res.Random != "r1" {
+		t.Fatal("echo:", res)
+	}
+	res = read("rpc", "missing", "c2")
+	if res.Err == "" || res.Random != "r2" {
+		t.Fatal("missing method:", res)
+	}
+}
+
+func TestLegacyPeerReply(t *testing.T) {
+	var ran int32
+	connected := make(chan *Client, 1)
+	port := startTestServer(t, func(s *WsServerConf) {
+		s.RegisterFunc("cb", "ask", func(in map[string]interface{}) error {
+			atomic.AddInt32(&ran, 1)
+			return nil
+		})
+		s.OnConnectFunc(func(c *Client) { connected <- c })
+	})
+	token, _ := bcrypt.GenerateFromPassword([]byte("test"), bcrypt.DefaultCost)
+	conn, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://127.0.0.1:%d/?token=%s", port, token), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := <-connected
+	done := make(chan error, 1)
+	go func() {
+		_, err := CallClientFunc(c, "cb", "ask", map[string]interface{}{"x": 1})
+		done <- err
+	}()
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	_, m, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var call map[string]interface{}
+	if err := LegacyCodec.Unmarshal(m, &call); err != nil {
+		t.Fatal(err)
+	}
+	//旧版本客户端的错误回复,错误字符串以n开头,与通知的id前缀相同
+	random := call["d"].(string)
+	reply, _ := LegacyCodec.Marshal(map[string]interface{}{"a": "cb", "b": "ask", "c": nil, "d": "no method", "e": "r" + random[1:]})
+	if err := conn.WriteMessage(websocket.TextMessage, reply); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "no method") {
+			t.Fatal("want no method error, got:", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("legacy reply was not delivered")
+	}
+	//未握手时n前缀的帧不作为通知
+	notify, _ := LegacyCodec.Marshal(map[string]interface{}{"a": "cb", "b": "ask", "c": nil, "d": "n"})
+	conn.WriteMessage(websocket.TextMessage, notify)
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt32(&ran); n != 0 {
+		t.Fatal("reply ran as call:", n)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	var lock sync.Mutex
+	var order []int
+	var running, most int32
+	step := func(in delayReq) (int, error) {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		lock.Lock()
+		if n > most {
+			most = n
+		}
+		lock.Unlock()
+		time.Sleep(time.Duration(in.Ms) * time.Millisecond)
+		lock.Lock()
+		order = append(order, in.Id)
+		lock.Unlock()
+		return in.Id, nil
+	}
+	port := startTestServer(t, func(s *WsServerConf) {
+		s.RegisterFunc("batch", "step", step)
+		s.RegisterFunc("batch", "fail", func() error { return NewError(CodeInvalidParams, "bad input") })
+	})
+	client := newTestClient(t, port, nil)
+	calls := []BatchCall{
+		{Waiter: "batch", Method: "step", In: delayReq{Id: 0, Ms: 150}},
+		{Waiter: "batch", Method: "step", In: delayReq{Id: 1, Ms: 100}},
+		{Waiter: "batch", Method: "step", In: delayReq{Id: 2, Ms: 50}},
+	}
+	check := func(results []BatchResult, err error) {
+		if err != nil || len(results) != len(calls) {
+			t.Fatal(results, err)
+		}
+		for i, r := range results {
+			var out int
+			if err := r.Decode(&out); err != nil || out != i {
+				t.Fatal("result", i, "got", out, err)
+			}
+		}
+	}
+	//顺序执行,前一项结束后才执行下一项
+	stat := func() (string, int32) {
+		lock.Lock()
+		defer lock.Unlock()
+		res, n := fmt.Sprint(order), most
+		order, most = nil, 0
+		return res, n
+	}
+	check(client.CallBatch(calls, true))
+	if got, n := stat(); got != "[0 1 2]" || n != 1 {
+		t.Fatal("sequential order:", got, "concurrency:", n)
+	}
+	//并发执行,先结束的项先完成,结果仍按调用顺序返回
+	check(client.CallBatch(calls, false))
+	if got, n := stat(); got != "[2 1 0]" || n != 3 {
+		t.Fatal("concurrent order:", got, "concurrency:", n)
+	}
+	//单项错误不影响其他项
+	results, err := client.CallBatch([]BatchCall{
+		{Waiter: "batch", Method: "fail"},
+		{Waiter: "batch", Method: "step", In: delayReq{Id: 1}},
+		{Waiter: "batch", Method: "missing"},
+		{Waiter: "none", Method: "step"},
+	}, false)
+	if err != nil || len(results) != 4 {
+		t.Fatal(results, err)
+	}
+	var e *RPCError
+	if !errors.As(results[0].Err, &e) || e.Code != CodeInvalidParams || e.Message != "bad input" {
+		t.Fatal("fail:", results[0].Err)
+	}
+	if out := 0; results[1].Decode(&out) != nil || out != 1 {
+		t.Fatal("step:", results[1])
+	}
+	if !errors.As(results[2].Err, &e) || e.Code != CodeNoMethod {
+		t.Fatal("missing method:", results[2].Err)
+	}
+	if !errors.As(results[3].Err, &e) || e.Code != CodeNoWaiter {
+		t.Fatal("missing waiter:", results[3].Err)
+	}
+}
+
+func TestWaitBatchResult(t *testing.T) {
+	back := make(chan *batchResultData, 1)
+	back <- &batchResultData{Type: "batch_result", Random: "1", Results: []resultData{{Out: 1.0}}}
+	var e *RPCError
+	if _, err := waitBatchResult(context.Background(), back, 2, func() {}); !errors.As(err, &e) || e.Code != CodeInternal {
+		t.Fatal("want count mismatch error, got:", err)
+	}
+	back <- &batchResultData{Type: "batch_result", Random: "1", Results: []resultData{{Out: 1.0}, {Err: &RPCError{}}}}
+	results, err := waitBatchResult(context.Background(), back, 2, func() {})
+	if err != nil || results[0].Out != 1.0 || results[1].Err != nil {
+		t.Fatal("empty error should be nil:", results, err)
+	}
+	//等待中连接断开
+	close(back)
+	if _, err := waitBatchResult(context.Background(), back, 2, func() {}); !errors.As(err, &e) || e.Code != CodeClosed {
+		t.Fatal("want closed error, got:", err)
+	}
+	//ctx结束时通知对端取消
+	canceled := false
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := waitBatchResult(ctx, make(chan *batchResultData), 2, func() { canceled = true }); !errors.As(err, &e) || e.Code != CodeCanceled || !canceled {
+		t.Fatal("want canceled error, got:", err, canceled)
+	}
+}
+
+func TestStreamFlowControl(t *testing.T) {
+	var sent int32
+	stopped := make(chan error, 1)
+	produce := func(stream *Stream) error {
+		for i := 0; ; i++ {
+			if err := stream.Send(i); err != nil {
+				stopped <- err
+				return err
+			}
+			atomic.AddInt32(&sent, 1)
+		}
+	}
+	port := startTestServer(t, func(s *WsServerConf) {
+		s.RegisterFunc("stream", "produce", produce)
+	})
+	client := newTestClient(t, port, nil)
+	//等待发送数量稳定
+	settle := func(want int32) {
+		deadline := time.Now().Add(2 * time.Second)
+		for atomic.LoadInt32(&sent) < want && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		time.Sleep(100 * time.Millisecond)
+		if n := atomic.LoadInt32(&sent); n != want {
+			t.Fatal("producer sent", n, "want", want)
+		}
+	}
+	s, err := client.CallStream(context.Background(), "stream", "produce", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//调用方不读取,执行方发满窗口后暂停
+	settle(streamWindow)
+	//读取半个窗口后授予额度,执行方继续发送
+	for i := 0; i < streamWindow/2; i++ {
+		var v int
+		if err := s.RecvTo(&v); err != nil || v != i {
+			t.Fatal("recv", i, "got", v, err)
+		}
+	}
+	settle(streamWindow + streamWindow/2)
+	//中途取消,阻塞在Send的执行方随之结束
+	s.Close()
+	select {
+	case err := <-stopped:
+		var e *RPCError
+		if !errors.As(err, &e) || e.Code != CodeCanceled {
+			t.Fatal("want canceled, got:", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("producer was not released")
+	}
+}
+
+func TestJSONRPCReply(t *testing.T) {
+	ws := &wsMethod{}
+	client := &Client{}
+	reply := func(format string) *resultData {
+		id, back := client.calls.add()
+		if r := ws.handleJSONRPC(client, []byte(fmt.Sprintf(format, id))); r != nil {
+			t.Fatal("reply should not be answered:", r.Error)
+		}
+		select {
+		case res := <-back:
+			return res
+		default:
+			t.Fatal("reply was not delivered:", format)
+			return nil
+		}
+	}
+	if res := reply(`{"jsonrpc":"2.0","result":null,"id":"%s"}`); res.Out != nil || res.Err != nil {
+		t.Fatal("null result:", res.Out, res.Err)
+	}
+	if res := reply(`{"jsonrpc":"2.0","result":{"sum":3},"id":"%s"}`); res.Err != nil || res.Out.(map[string]interface{})["sum"] != 3.0 {
+		t.Fatal("value result:", res.Out, res.Err)
+	}
+	res := reply(`{"jsonrpc":"2.0","error":{"code":-32602,"message":"bad","data":{"field":"a"}},"id":"%s"}`)
+	if res.Err == nil || res.Err.Code != CodeInvalidParams || res.Err.Message != "bad" || res.Err.Details["field"] != "a" {
+		t.Fatal("error result:", res.Err)
+	}
+	//既无result也无error时不是回复
+	if r := ws.handleJSONRPC(client, []byte(`{"jsonrpc":"2.0","id":"1"}`)); r == nil || r.Error.Code != CodeInvalidRequest {
+		t.Fatal("want invalid request, got:", r)
+	}
+}
+
+func TestJSONRPCConn(t *testing.T) {
+	pushed := make(chan int, 1)
+	connected := make(chan *Client, 1)
+	port := startTestServer(t, func(s *WsServerConf) {
+		s.RegisterFunc("note", "push", func(in int) error {
+			pushed <- in
+			return nil
+		})
+		s.OnConnectFunc(func(c *Client) { connected <- c })
+	})
+	token, _ := bcrypt.GenerateFromPassword([]byte("test"), bcrypt.DefaultCost)
+	dialer := websocket.Dialer{Subprotocols: []string{JSONRPCProtocol}}
+	conn, _, err := dialer.Dial(fmt.Sprintf("ws://127.0.0.1:%d/?token=%s", port, token), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := <-connected
+	write := func(msg string) {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func(v interface{}) {
+		conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		_, m, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(m, v); err != nil {
+			t.Fatal(string(m), err)
+		}
+	}
+	//请求
+	write(`{"jsonrpc":"2.0","method":"rpc.echo","params":{"x":1},"id":1}`)
+	var res jsonrpcMessage
+	read(&res)
+	if string(res.Id) != "1" || res.Result == nil || string(*res.Result) != `{"x":1}` {
+		t.Fatal("request:", res)
+	}
+	//通知执行后不回复,下一帧为批量请求的回复
+	write(`{"jsonrpc":"2.0","method":"note.push","params":[5]}`)
+	select {
+	case v := <-pushed:
+		if v != 5 {
+			t.Fatal("notify value:", v)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("notify did not run")
+	}
+	write(`[{"jsonrpc":"2.0","method":"rpc.delay","params":{"id":2},"id":2},{"jsonrpc":"2.0","method":"note.push","params":[6]},{"jsonrpc":"2.0","method":"rpc.echo","params":{"y":3},"id":3}]`)
+	var batch []jsonrpcMessage
+	read(&batch)
+	if len(batch) != 2 || string(batch[0].Id) != "2" || string(*batch[0].Result) != "2" || string(batch[1].Id) != "3" {
+		t.Fatal("batch:", batch)
+	}
+	<-pushed
+	//服务端调用客户端,客户端按id回复
+	done := make(chan error, 1)
+	go func() {
+		out, err := CallClient[int, int](c, "cb", "double", 3)
+		if err == nil && out != 6 {
+			err = fmt.Errorf("got %d", out)
+		}
+		done <- err
+	}()
+	var req jsonrpcMessage
+	read(&req)
+	if req.Method != "cb.double" || len(req.Id) == 0 {
+		t.Fatal("server request:", req)
+	}
+	write(fmt.Sprintf(`{"jsonrpc":"2.0","result":6,"id":%s}`, req.Id))
+	if err := <-done; err != nil {
+		t.Fatal("server call:", err)
+	}
+	//批量调用客户端,回复为数组
+	go func() {
+		out, err := CallClientBatch(c, []BatchCall{{Waiter: "cb", Method: "double", In: 1}, {Waiter: "cb", Method: "double", In: 2}}, false)
+		if err == nil && (out[0].Out != 2.0 || out[1].Err == nil) {
+			err = fmt.Errorf("got %v", out)
+		}
+		done <- err
+	}()
+	var reqs []jsonrpcMessage
+	read(&reqs)
+	if len(reqs) != 2 {
+		t.Fatal("server batch:", reqs)
+	}
+	write(fmt.Sprintf(`[{"jsonrpc":"2.0","result":2,"id":%s},{"jsonrpc":"2.0","error":{"code":-32601,"message":"no method"},"id":%s}]`, reqs[0].Id, reqs[1].Id))
+	if err := <-done; err != nil {
+		t.Fatal("server batch:", err)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	big := strings.Repeat("compress me ", 8<<10)
+	token, _ := bcrypt.GenerateFromPassword([]byte("test"), bcrypt.DefaultCost)
+	cases := []struct {
+		server, client bool
+	}{
+		{true, true},
+		{true, false},
+		{false, true},
+	}
+	for _, tc := range cases {
+		port := startTestServer(t, func(s *WsServerConf) {
+			s.SetCompression(tc.server, 16)
+		})
+		client := newTestClient(t, port, func(w *WSRpcClient) {
+			w.SetCompression(tc.client, 16)
+		})
+		//双方都启用时才协商压缩
+		if h := client.Handshake(); h == nil || h.Compression != (tc.server && tc.client) {
+			t.Fatal(tc, "bad handshake:", h)
+		}
+		for _, text := range []string{"small", big} {
+			out, err := client.CallFunc("rpc", "echo", map[string]interface{}{"text": text})
+			if err != nil || out["text"] != text {
+				t.Fatal(tc, "echo failed:", len(text), err)
+			}
+		}
+		//websocket层按同样的条件协商permessage-deflate
+		dialer := websocket.Dialer{EnableCompression: tc.client}
+		conn, resp, err := dialer.Dial(fmt.Sprintf("ws://127.0.0.1:%d/?token=%s", port, token), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		if ext := resp.Header.Get("Sec-Websocket-Extensions"); strings.Contains(ext, "permessage-deflate") != (tc.server && tc.client) {
+			t.Fatal(tc, "bad extensions:", ext)
+		}
+	}
+}
+
+func TestServerSendLimit(t *testing.T) {
+	connected := make(chan *Client, 1)
+	port := startTestServer(t, func(s *WsServerConf) {
+		s.RegisterFunc("size", "big", func() (string, error) {
+			return strings.Repeat("x", 4096), nil
+		})
+		s.OnConnectFunc(func(c *Client) { connected <- c })
+	})
+	client := newTestClient(t, port, func(w *WSRpcClient) {
+		w.SetMaxMessageSize(1024)
+	})
+	//结果超出客户端上限时改为回复错误,连接保持
+	var e *RPCError
+	if _, err := Call[interface{}, string](client, "size", "big", nil); !errors.As(err, &e) || e.Code != CodeInvalidRequest {
+		t.Fatal("want size error, got:", err)
+	}
+	//调用客户端时参数超出上限,不发送
+	c := <-connected
+	if _, err := CallClient[string, interface{}](c, "size", "big", strings.Repeat("x", 4096)); !errors.As(err, &e) || e.Code != CodeInvalidRequest {
+		t.Fatal("want size error, got:", err)
+	}
+	if err := NotifyClient(c, "size", "big", strings.Repeat("x", 4096)); !errors.As(err, &e) || e.Code != CodeInvalidRequest {
+		t.Fatal("want size error, got:", err)
+	}
+	if out, err := Call[map[string]interface{}, map[string]interface{}](client, "rpc", "echo", map[string]interface{}{"x": 1}); err != nil || out["x"] != 1.0 {
+		t.Fatal("connection should stay open:", out, err)
+	}
+}
+
+func TestSendClientBlobChunkSize(t *testing.T) {
+	connected := make(chan *Client, 1)
+	port := startTestServer(t, func(s *WsServerConf) {
+		s.OnConnectFunc(func(c *Client) { connected <- c })
+	})
+	store, err := NewFileBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	newTestClient(t, port, func(w *WSRpcClient) {
+		w.SetMaxMessageSize(16 << 10)
+		w.SetBlobReceiver(&BlobReceiver{Store: store, Done: func(c *Client, info BlobInfo, err error) {
+			done <- err
+		}})
+	})
+	//分块按客户端的消息上限切分,超出时客户端会断开连接
+	data := bytes.Repeat([]byte("0123456789"), 20<<10)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	info := BlobInfo{Id: "down-1"}
+	if err := SendClientBlob(ctx, <-connected, info, bytes.NewReader(data), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(store.Path(nil, info.Id)); !bytes.Equal(got, data) {
+		t.Fatal("content mismatch:", len(got))
+	}
+}
+
+func TestInterceptBatch(t *testing.T) {
+	var lock sync.Mutex
+	var seen []string
+	record := func(ctx context.Context, info *CallInfo, next UnaryHandler) (interface{}, error) {
+		lock.Lock()
+		seen = append(seen, info.Method)
+		lock.Unlock()
+		return next(ctx, info)
+	}
+	deny := func(ctx context.Context, info *CallInfo, next UnaryHandler) (interface{}, error) {
+		if info.Method == "secret" {
+			return nil, NewError(CodePermissionDenied, "denied")
+		}
+		info.In = map[string]interface{}{"x": "changed"}
+		return next(ctx, info)
+	}
+	taken := func() string {
+		lock.Lock()
+		defer lock.Unlock()
+		sort.Strings(seen)
+		res := strings.Join(seen, ",")
+		seen = nil
+		return res
+	}
+	connected := make(chan *Client, 1)
+	port := startTestServer(t, func(s *WsServerConf) {
+		s.UnaryInterceptorFunc(record)
+		s.ClientCallInterceptorFunc(deny)
+		s.RegisterFunc("stream", "count", func(stream *Stream) error {
+			return stream.Send(1)
+		})
+		s.OnConnectFunc(func(c *Client) { connected <- c })
+	})
+	client := newTestClient(t, port, func(w *WSRpcClient) {
+		w.CallInterceptorFunc(deny)
+		w.RegisterFunc("rpc", "echo", func(in map[string]interface{}) (map[string]interface{}, error) {
+			return in, nil
+		})
+	})
+	check := func(results []BatchResult, err error) {
+		if err != nil || len(results) != 3 {
+			t.Fatal(results, err)
+		}
+		var e *RPCError
+		if !errors.As(results[1].Err, &e) || e.Code != CodePermissionDenied {
+			t.Fatal("secret should be denied by the caller:", results[1].Err)
+		}
+		for _, i := range []int{0, 2} {
+			if out, ok := results[i].Out.(map[string]interface{}); !ok || out["x"] != "changed" {
+				t.Fatal("item", i, "should carry the changed input:", results[i])
+			}
+		}
+	}
+	calls := []BatchCall{
+		{Waiter: "rpc", Method: "echo", In: map[string]interface{}{"x": 1}},
+		{Waiter: "rpc", Method: "secret"},
+		{Waiter: "rpc", Method: "echo", In: map[string]interface{}{"x": 2}},
+	}
+	//调用方与执行方的拦截器对批量调用的每一项分别执行,被拦截的项不发送
+	check(client.CallBatch(calls, false))
+	if got := taken(); got != "echo,echo" {
+		t.Fatal("server interceptor saw:", got)
+	}
+	check(CallClientBatch(<-connected, calls, true))
+	//流式调用不经过拦截器
+	s, err := client.CallStream(context.Background(), "stream", "count", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Recv(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Recv(); err != io.EOF {
+		t.Fatal("want EOF, got:", err)
+	}
+	if got := taken(); got != "" {
+		t.Fatal("stream should not be intercepted:", got)
+	}
+	//拦截器重复调用next时,之后的调用单独发送
+	var sizes []int
+	send := func(ctx context.Context, calls []BatchCall) ([]BatchResult, error) {
+		sizes = append(sizes, len(calls))
+		res := make([]BatchResult, len(calls))
+		for i, call := range calls {
+			res[i].Out = call.Method
+		}
+		return res, nil
+	}
+	retry := func(ctx context.Context, info *CallInfo, next UnaryHandler) (interface{}, error) {
+		out, err := next(ctx, info)
+		if info.Method == "b" {
+			return next(ctx, info)
+		}
+		return out, err
+	}
+	results, err := interceptBatch(context.Background(), []UnaryInterceptor{retry}, nil,
+		[]BatchCall{{Method: "a"}, {Method: "b"}}, send)
+	if err != nil || results[0].Out != "a" || results[1].Out != "b" || fmt.Sprint(sizes) != "[2 1]" {
+		t.Fatal("retry:", results, err, sizes)
+	}
+}
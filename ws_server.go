@@ -1,6 +1,7 @@
 package ws_rpc
 
 import (
+	"context"
 	"errors"
 	"golang.org/x/crypto/bcrypt"
 	"time"
@@ -12,22 +13,67 @@ type WsServerConf struct {
 	ticker      int64
 	secret      string
 	method      []MiddlewareFunc
-	waiter      map[string]*Waiter
+	waiter      *waiterTable
 	closeFunc   CallbackFunc
 	connectFunc CallbackFunc
+	panicFunc   PanicFunc
+	codec       Codec
+	codecs      map[string]Codec
+	conf        SeverConf
+	blob        *BlobReceiver
+	//客户端发起的调用的拦截器
+	interceptors []UnaryInterceptor
+	//向客户端发起的调用的拦截器
+	callInterceptors []UnaryInterceptor
+	//调用权限策略
+	policies *policyTable
 }
 
 type CallbackFunc func(client *Client)
 
 func NewWsRpcServer(port int64, secret string) WsServerConf {
-	return WsServerConf{
-		port:   port,
-		path:   "/",
-		ticker: Ticker,
-		secret: secret,
-		method: make([]MiddlewareFunc, 0),
-		waiter: make(map[string]*Waiter),
+	s := WsServerConf{
+		port:     port,
+		path:     "/",
+		ticker:   Ticker,
+		secret:   secret,
+		method:   make([]MiddlewareFunc, 0),
+		waiter:   newWaiterTable(),
+		policies: newPolicyTable(),
+		codec:    DefaultCodec,
+		codecs:   builtinCodecs(),
+		conf:     SeverConf{MaxMessageSize: DefaultMaxMessageSize},
 	}
+	s.waiter.registerReflection(s.policies)
+	return s
+}
+
+//启用permessage-deflate压缩,小于threshold字节的消息不压缩
+func (s *WsServerConf) SetCompression(enable bool, threshold int) {
+	s.conf.Compression = enable
+	s.conf.CompressionThreshold = threshold
+}
+
+//单条消息最大字节数,超出时以1009关闭连接,0为不限制,默认DefaultMaxMessageSize
+func (s *WsServerConf) SetMaxMessageSize(size int64) {
+	s.conf.MaxMessageSize = size
+}
+
+//接收客户端发来的文件
+func (s *WsServerConf) SetBlobReceiver(receiver *BlobReceiver) {
+	s.blob = receiver
+}
+
+//读写超时,0为不限制,读超时需大于客户端心跳间隔
+func (s *WsServerConf) SetTimeout(read, write time.Duration) {
+	s.conf.ReadTimeout = read
+	s.conf.WriteTimeout = write
+}
+
+//收到消息的并发处理限制,conn为每个连接,server为整个服务,Workers为0时不限制
+func (s *WsServerConf) SetWorkers(conn, server WorkerConf) {
+	s.conf.Workers = conn
+	s.conf.ServerWorkers = server
 }
 
 func (s *WsServerConf) MiddlewareFunc(method ...MiddlewareFunc) {
@@ -42,22 +88,63 @@ func (s *WsServerConf) OnCloseFunc(method CallbackFunc) {
 	s.closeFunc = method
 }
 
-func (s *WsServerConf) RegisterWaiter(waiter string, method interface{}) {
-	w := NewWaiter(method)
-	s.waiter[stringToLower(waiter)] = w
+//方法panic时调用,默认打印日志,调用方收到CodeInternal错误
+func (s *WsServerConf) OnPanicFunc(method PanicFunc) {
+	s.panicFunc = method
 }
 
-func (s *WsServerConf) Start() error {
-	conf := SeverConf{
-		Port:   s.port,
-		Path:   s.path,
-		Ticker: s.ticker,
+//设置默认编码,客户端未指定codec参数时使用
+func (s *WsServerConf) SetCodec(codec Codec) {
+	s.codec = codec
+	s.RegisterCodec(codec)
+}
+
+//注册可供客户端选择的编码
+func (s *WsServerConf) RegisterCodec(codec Codec) {
+	s.codecs[codec.Name()] = codec
+}
+
+//注册服务,可通过选项排除方法或指定调用名,方法形式不可用时返回错误且不注册
+func (s *WsServerConf) RegisterWaiter(waiter string, method interface{}, opts ...WaiterOption) error {
+	w, err := NewWaiter(method, opts...)
+	if err != nil {
+		if e, ok := err.(*MethodError); ok {
+			e.Waiter = waiter
+		}
+		return err
 	}
+	s.waiter.set(waiter, w)
+	return nil
+}
+
+//注册函数或闭包为方法,method为调用名,函数形式同服务方法,服务不存在时创建,可在启动后调用
+func (s *WsServerConf) RegisterFunc(waiter, method string, fn interface{}) error {
+	return s.waiter.addFunc(waiter, method, fn, false)
+}
+
+//移除方法,method为空时移除整个服务,不存在时返回false
+func (s *WsServerConf) Unregister(waiter, method string) bool {
+	return s.waiter.remove(waiter, method)
+}
+
+func (s *WsServerConf) Start() error {
+	conf := s.conf
+	conf.Port = s.port
+	conf.Path = s.path
+	conf.Ticker = s.ticker
+	conf.Subprotocols = []string{JSONRPCProtocol}
 	hashLoop := NewHashLoop(1000)
 	ws := NewWsServer(conf, &wsMethod{
-		waiter:      s.waiter,
-		closeFunc:   s.closeFunc,
-		connectFunc: s.connectFunc,
+		waiter:           s.waiter,
+		closeFunc:        s.closeFunc,
+		connectFunc:      s.connectFunc,
+		panicFunc:        s.panicFunc,
+		codec:            s.codec,
+		codecs:           s.codecs,
+		blob:             s.blob,
+		interceptors:     s.interceptors,
+		callInterceptors: s.callInterceptors,
+		policies:         s.policies,
 	})
 	ws.MiddlewareFunc(func(c Context) error {
 		token := c.GetFrom()["token"]
@@ -68,6 +155,14 @@ func (s *WsServerConf) Start() error {
 		if !hashLoop.Loop(token) {
 			return errors.New("key has been used")
 		}
+		if name := c.GetFrom()["codec"]; name != "" {
+			if _, ok := s.codecs[name]; !ok {
+				return errors.New("unsupported codec")
+			}
+		}
+		if p := c.GetFrom()["protocol"]; p != "" && p != JSONRPCProtocol {
+			return errors.New("unsupported protocol")
+		}
 		return nil
 	})
 	ws.MiddlewareFunc(s.method...)
@@ -77,78 +172,231 @@ func (s *WsServerConf) Start() error {
 }
 
 type wsMethod struct {
-	waiter      map[string]*Waiter
-	closeFunc   CallbackFunc
-	connectFunc CallbackFunc
+	waiter           *waiterTable
+	closeFunc        CallbackFunc
+	connectFunc      CallbackFunc
+	panicFunc        PanicFunc
+	codec            Codec
+	codecs           map[string]Codec
+	blob             *BlobReceiver
+	interceptors     []UnaryInterceptor
+	callInterceptors []UnaryInterceptor
+	policies         *policyTable
 }
 
+//调用客户端方法,超时时间为TimeOut秒
 func CallClientFunc(client *Client, waiter, method string, in map[string]interface{}) (map[string]interface{}, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(TimeOut)*time.Second)
+	defer cancel()
+	return CallClientFuncContext(ctx, client, waiter, method, in)
+}
+
+//调用客户端方法,按ctx的截止时间与取消结束等待
+func CallClientFuncContext(ctx context.Context, client *Client, waiter, method string, in map[string]interface{}) (map[string]interface{}, error) {
+	out, err := callClientValue(ctx, client, waiter, method, in)
+	if err != nil {
+		return nil, err
+	}
+	return decodeMap(out)
+}
+
+func callClientValue(ctx context.Context, client *Client, waiter, method string, in interface{}) (interface{}, error) {
 	if client == nil {
-		return nil, errors.New("client is close")
-	}
-	return func() (map[string]interface{}, error) {
-		client.callLock.Lock()
-		defer func() {
-			client.callLock.Unlock()
-			recover()
-		}()
-		rand := getRandString(4)
-		res, err := createCallData(waiter, method, rand, in)
+		return nil, errClosed()
+	}
+	info := newCallInfo(client, waiter, method, in, false)
+	return intercept(ctx, client.interceptors, info, func(ctx context.Context, info *CallInfo) (interface{}, error) {
+		if client.jsonrpc {
+			return callClientJSONRPC(ctx, client, info.Waiter, info.Method, info.In)
+		}
+		//回复按id投递到各自的调用,同一客户端可同时进行多个调用
+		id, back := client.calls.add()
+		defer client.calls.remove(id)
+		res, err := createCallData(client.codec, info.Waiter, info.Method, id, info.In)
 		if err != nil {
 			return nil, err
 		}
-		client.Manager.SendMsgToClient(client, res)
-		t := time.NewTicker(time.Duration(TimeOut) * time.Second)
-		defer func() {
-			t.Stop()
-		}()
-		for {
-			select {
-			case callback := <-client.callChan:
-				if callback.Random == rand &&
-					callback.Waiter == waiter &&
-					callback.Method == stringToLower(method) {
-					var err error
-					if callback.Err != "" {
-						err = errors.New(callback.Err)
-					} else {
-						err = nil
-					}
-					return callback.Out, err
-				}
-			case <-t.C:
-				return nil, errors.New("call func timeout")
+		if err = sendData(client, res); err != nil {
+			return nil, err
+		}
+		return waitResult(ctx, back, func() {
+			//通知客户端停止执行
+			if m, err := createCancelData(client.codec, id); err == nil {
+				sendData(client, m)
 			}
+		})
+	})
+}
+
+//通知客户端方法,不等待回复
+func NotifyClient(client *Client, waiter, method string, in interface{}) error {
+	if client == nil {
+		return errClosed()
+	}
+	info := newCallInfo(client, waiter, method, in, true)
+	_, err := intercept(context.Background(), client.interceptors, info, func(ctx context.Context, info *CallInfo) (interface{}, error) {
+		if client.jsonrpc {
+			return nil, notifyClientJSONRPC(client, info.Waiter, info.Method, info.In)
 		}
-	}()
+		res, err := createNotifyData(client.codec, info.Waiter, info.Method, info.In)
+		if err != nil {
+			return nil, err
+		}
+		return nil, sendData(client, res)
+	})
+	return err
+}
+
+//按连接协商的编码发送rpc帧,超出客户端消息大小上限时不发送
+func sendData(client *Client, data []byte) error {
+	if peer := client.Handshake(); peer != nil && peer.MaxMessageSize > 0 && int64(len(data)) > peer.MaxMessageSize {
+		return Errorf(CodeInvalidRequest, "message size %d exceeds client limit %d", len(data), peer.MaxMessageSize)
+	}
+	if client.codec.Binary() {
+		client.SendBinary(data)
+	} else {
+		client.SendMsg(data)
+	}
+	return nil
+}
+
+//回复调用,结果无法编码或超出客户端消息大小上限时改为回复该错误
+func sendResult(client *Client, call *callData, out interface{}, err error) {
+	m, e := createResultData(client.codec, call, out, err, client.Handshake() == nil)
+	if e == nil {
+		e = sendData(client, m)
+	}
+	if e != nil && out != nil {
+		if m, e = createResultData(client.codec, call, nil, e, client.Handshake() == nil); e == nil {
+			sendData(client, m)
+		}
+	}
 }
 
 func (ws *wsMethod) OnConnect(client *Client) {
+	client.codec = ws.codec
+	client.interceptors = ws.callInterceptors
+	if codec, ok := ws.codecs[client.Context.GetFrom()["codec"]]; ok {
+		client.codec = codec
+	}
+	if client.Subprotocol() == JSONRPCProtocol || client.Context.GetFrom()["protocol"] == JSONRPCProtocol {
+		//JSON-RPC固定使用json文本帧
+		client.jsonrpc = true
+		client.codec = JSONCodec
+	}
 	if ws.connectFunc != nil {
 		ws.connectFunc(client)
 	}
 }
 
-//收到信息时处理
+//各类帧均在OnOrderedMessage中分派,未识别的帧不处理
 func (ws *wsMethod) OnMessage(client *Client, msg []byte) {
-	if res, ok := isCallWsFunc(msg); ok {
-		//远程调用
-		var err error
-		out := make(map[string]interface{})
-		if waiter, ok := ws.waiter[res.Waiter]; ok {
-			out, err = waiter.RunMethod(res.Method, client, res.In)
-
-		} else {
-			err = errors.New("no waiter")
+}
+
+//在读取时登记调用,投递到处理池执行,排队中即可被取消,队列满时按策略回复CodeBusy错误或丢弃
+func (ws *wsMethod) submitCall(client *Client, res *callData) {
+	if res.notify {
+		//通知,执行后不回复
+		client.submit(func() { ws.invoke(context.Background(), client, res, nil) })
+		return
+	}
+	ctx, done := client.running.add(res.Random)
+	policy, ok := client.submit(func() { ws.runCall(ctx, client, res, done) })
+	if ok {
+		return
+	}
+	done()
+	if policy == OverflowReject {
+		if m, err := createResultData(client.codec, res, nil, errBusy(), client.Handshake() == nil); err == nil {
+			sendData(client, m)
 		}
-		m, err := createResultData(res, out, err)
-		if err != nil {
-			return
+	}
+}
+
+//远程调用
+func (ws *wsMethod) runCall(ctx context.Context, client *Client, res *callData, done func()) {
+	defer done()
+	out, err := ws.invoke(ctx, client, res, nil)
+	sendResult(client, res, out, err)
+}
+
+//执行客户端发起的调用,stream不为nil时为流式调用
+func (ws *wsMethod) invoke(ctx context.Context, client *Client, res *callData, stream *Stream) (interface{}, error) {
+	interceptors := ws.interceptors
+	if stream != nil {
+		interceptors = nil
+	}
+	return safeCall(ws.panicFunc, res, func() (interface{}, error) {
+		info := newCallInfo(client, res.Waiter, res.Method, res.In, res.notify)
+		return intercept(ctx, interceptors, info, func(ctx context.Context, info *CallInfo) (interface{}, error) {
+			//按注册时的调用名检查,方法不存在时仍检查服务的策略
+			waiter, ok := ws.waiter.get(info.Waiter)
+			call := ""
+			if ok {
+				call, _ = waiter.callName(info.Method)
+			}
+			if err := ws.policies.check(client, info.Waiter, call); err != nil {
+				return nil, err
+			}
+			if !ok {
+				return nil, NewError(CodeNoWaiter, "no waiter")
+			}
+			return waiter.run(ctx, info.Method, client, info.In, stream)
+		})
+	})
+}
+
+//各类帧均在读取协程中分派,握手,流与文件传输帧按接收顺序处理,回复与取消帧立即处理,
+//调用与批量调用投递到处理池,执行中的方法等待对端回复时不会阻塞回复帧
+func (ws *wsMethod) OnOrderedMessage(client *Client, msg []byte) bool {
+	if client.jsonrpc {
+		return ws.orderedJSONRPC(client, msg)
+	}
+	send := func(data []byte) error {
+		return sendData(client, data)
+	}
+	if client.blobs.dispatch(client.codec, msg, client, ws.blob, send) {
+		return true
+	}
+	if hello, ok := isHelloWsFunc(msg, "hello"); ok {
+		ws.onHello(client, hello)
+		return true
+	}
+	if res, ok := isStreamWsFunc(client.codec, msg); ok {
+		dispatchStream(&client.streams, &client.serving, res)
+		return true
+	}
+	//回复帧先于调用帧解析,旧版本客户端的回复不会被当作调用
+	if res, ok := isResWsFunc(client.codec, msg); ok {
+		client.calls.done(res.Random, res)
+		return true
+	}
+	if res, ok := isCallWsFunc(client.codec, msg, client.Handshake()); ok {
+		if !res.stream {
+			ws.submitCall(client, res)
+			return true
+		}
+		s, done := ws.acceptStream(client, res)
+		if _, ok := client.submit(func() { ws.runStream(client, res, s, done) }); !ok {
+			//队列已满,流以CodeBusy错误结束
+			s.end(errBusy())
+			done()
 		}
-		client.SendMsg(m)
-	} else if res, ok := isResWsFunc(msg); ok {
-		client.callChan <- res
+		return true
+	}
+	if res, ok := isCancelWsFunc(client.codec, msg); ok {
+		client.running.cancel(res.Random)
+		return true
+	}
+	if res, ok := isBatchWsFunc(client.codec, msg); ok {
+		ws.submitBatch(client, res)
+		return true
+	}
+	if res, ok := isBatchResultWsFunc(client.codec, msg); ok {
+		client.batches.done(res.Random, res)
+		return true
 	}
+	return false
 }
 
 //断开连接